@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/cblomart/s3vol/driver"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+//NewDriver gets a driver for the administration commands
+func NewDriver(c *cli.Context) (*driver.S3fsDriver, error) {
+	// keep the output clean unless debugging
+	log.SetLevel(log.WarnLevel)
+	if c.Bool("debug") {
+		log.SetLevel(log.DebugLevel)
+	}
+	d, err := driver.NewAdminDriver(c)
+	if err != nil {
+		return nil, fmt.Errorf("cannot instantiate driver: %s", err)
+	}
+	return d, nil
+}
+
+//CheckFormat checks the requested output format
+func CheckFormat(c *cli.Context) error {
+	switch c.String("format") {
+	case "table", "json":
+		return nil
+	default:
+		return fmt.Errorf("unknown output format '%s': use table or json", c.String("format"))
+	}
+}
+
+//Output writes the value as json or as the table written by rows, in the requested format
+func Output(c *cli.Context, value interface{}, header string, rows func(w io.Writer)) error {
+	err := CheckFormat(c)
+	if err != nil {
+		return err
+	}
+	if c.String("format") == "json" {
+		enc := json.NewEncoder(c.App.Writer)
+		enc.SetIndent("", "  ")
+		return enc.Encode(value)
+	}
+	w := tabwriter.NewWriter(c.App.Writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	rows(w)
+	return w.Flush()
+}
@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+// formatContext gets a command context with an output format writing to a buffer
+func formatContext(format string) (*cli.Context, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("format", format, "")
+	return cli.NewContext(&cli.App{Writer: out}, set, nil), out
+}
+
+func TestOutput(t *testing.T) {
+	values := []map[string]string{{"name": "vol1"}, {"name": "volume2"}}
+	rows := func(w io.Writer) {
+		for _, v := range values {
+			fmt.Fprintf(w, "%s\t%d\n", v["name"], len(v["name"]))
+		}
+	}
+	tests := []struct {
+		format   string
+		expected string
+		err      string
+	}{
+		{"table", "NAME     LENGTH\nvol1     4\nvolume2  7\n", ""},
+		{"json", "[\n  {\n    \"name\": \"vol1\"\n  },\n  {\n    \"name\": \"volume2\"\n  }\n]\n", ""},
+		{"yaml", "", "unknown output format 'yaml'"},
+	}
+	for _, test := range tests {
+		c, out := formatContext(test.format)
+		err := Output(c, values, "NAME\tLENGTH", rows)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.format, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.format, err)
+			continue
+		}
+		if out.String() != test.expected {
+			t.Errorf("%s: output %q, expected %q", test.format, out.String(), test.expected)
+		}
+	}
+}
@@ -1,12 +1,174 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/cblomart/s3vol/locks"
 	"github.com/cblomart/s3vol/serve"
+	"github.com/cblomart/s3vol/volumes"
 	"github.com/urfave/cli/v2"
 )
 
+// s3Flags are the flags to connect to s3 and the configuration bucket
+var s3Flags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "endpoint",
+		Aliases: []string{"e"},
+		Value:   "http://localhost:9000",
+		EnvVars: []string{"S3VOL_ENDPOINT"},
+		Usage:   "s3 endpoint",
+	},
+	&cli.StringFlag{
+		Name:    "accesskey",
+		Aliases: []string{"k"},
+		EnvVars: []string{"S3VOL_ACCESSKEY"},
+		Usage:   "s3 accesskey (static credentials)",
+	},
+	&cli.StringFlag{
+		Name:    "secretkey",
+		Aliases: []string{"s"},
+		EnvVars: []string{"S3VOL_SECRETKEY"},
+		Usage:   "s3 secretkey (static credentials)",
+	},
+	&cli.StringFlag{
+		Name:    "region",
+		Aliases: []string{"r"},
+		Value:   "us-east-1",
+		EnvVars: []string{"S3VOL_REGION"},
+		Usage:   "s3 region",
+	},
+	&cli.StringFlag{
+		Name:    "sessiontoken",
+		EnvVars: []string{"S3VOL_SESSIONTOKEN"},
+		Usage:   "s3 session token (temporary static credentials)",
+	},
+	&cli.StringFlag{
+		Name:    "credentials",
+		Value:   "static",
+		EnvVars: []string{"S3VOL_CREDENTIALS"},
+		Usage:   "s3 credentials source (static or iam)",
+	},
+	&cli.StringFlag{
+		Name:    "iam-endpoint",
+		Value:   "",
+		EnvVars: []string{"S3VOL_IAMENDPOINT"},
+		Usage:   "metadata or sts endpoint of the iam credentials (aws defaults if empty)",
+	},
+	&cli.StringFlag{
+		Name:    "web-identity-token-file",
+		Value:   "",
+		EnvVars: []string{"AWS_WEB_IDENTITY_TOKEN_FILE"},
+		Usage:   "web identity token to assume a role with sts (iam credentials)",
+	},
+	&cli.StringFlag{
+		Name:    "role-arn",
+		Value:   "",
+		EnvVars: []string{"AWS_ROLE_ARN"},
+		Usage:   "role assumed with the web identity token",
+	},
+	&cli.BoolFlag{
+		Name:    "replaceunderscores",
+		Aliases: []string{"u"},
+		Value:   true,
+		EnvVars: []string{"S3VOL_REPLACEUNDERSCORES"},
+		Usage:   "replace underscores by ---",
+	},
+	&cli.StringFlag{
+		Name:    "configbucket",
+		Aliases: []string{"b"},
+		Value:   "s3volconfig",
+		EnvVars: []string{"S3VOL_CONFIGBUCKET"},
+		Usage:   "bucket to store configuration",
+	},
+	&cli.StringFlag{
+		Name:    "lock-backend",
+		Value:   "s3",
+		EnvVars: []string{"S3VOL_LOCKBACKEND"},
+		Usage:   "lock backend (s3, file or etcd)",
+	},
+	&cli.BoolFlag{
+		Name:    "lock-unconditional",
+		EnvVars: []string{"S3VOL_LOCKUNCONDITIONAL"},
+		Usage:   "allow unsafe s3 locks on endpoints without conditional writes",
+	},
+	&cli.StringFlag{
+		Name:    "lock-endpoints",
+		Value:   "",
+		EnvVars: []string{"S3VOL_LOCKENDPOINTS"},
+		Usage:   "comma separated etcd endpoints (http://host:port)",
+	},
+	&cli.StringFlag{
+		Name:    "lock-prefix",
+		Value:   "s3vol",
+		EnvVars: []string{"S3VOL_LOCKPREFIX"},
+		Usage:   "etcd key prefix for locks",
+	},
+	&cli.StringFlag{
+		Name:    "lock-dir",
+		Value:   "/run/s3vol/locks",
+		EnvVars: []string{"S3VOL_LOCKDIR"},
+		Usage:   "directory of the file locks",
+	},
+	&cli.StringFlag{
+		Name:    "allowed-paths",
+		Value:   "/tmp",
+		EnvVars: []string{"S3VOL_ALLOWEDPATHS"},
+		Usage:   "comma separated directories allowed in volume path options (use_cache, tmpdir...)",
+	},
+	&cli.StringFlag{
+		Name:    "config-key",
+		Value:   "",
+		EnvVars: []string{"S3VOL_CONFIGKEY"},
+		Usage:   "passphrase encrypting the volume secrets in the config bucket (needed for volumes with their own credentials)",
+	},
+	&cli.StringFlag{
+		Name:    "credentials-file",
+		Value:   "",
+		EnvVars: []string{"S3VOL_CREDENTIALSFILE"},
+		Usage:   "file of named credential profiles (aws shared credentials or toml)",
+	},
+	&cli.IntFlag{
+		Name:    "retention",
+		Value:   0,
+		EnvVars: []string{"S3VOL_RETENTION"},
+		Usage:   "days to keep the data of removed volumes in the trash (0 deletes it immediately, the retention saved by the plugin if unset)",
+	},
+	&cli.StringFlag{
+		Name:    "snapshot-bucket",
+		Value:   "s3volsnapshots",
+		EnvVars: []string{"S3VOL_SNAPSHOTBUCKET"},
+		Usage:   "bucket of the volume snapshots (on the endpoint of each volume)",
+	},
+	&cli.StringFlag{
+		Name:    "backend",
+		Value:   "s3fs",
+		EnvVars: []string{"S3VOL_BACKEND"},
+		Usage:   "default mount backend (s3fs, goofys, rclone, mountpoint-s3 or native)",
+	},
+}
+
+// formatFlag selects the output format of the volume commands
+var formatFlag = &cli.StringFlag{
+	Name:    "format",
+	Aliases: []string{"f"},
+	Value:   "table",
+	Usage:   "output format (table or json)",
+}
+
+// stateFlag is the file keeping the mounts of the host
+var stateFlag = &cli.StringFlag{
+	Name:    "statefile",
+	Value:   "/var/lib/s3vol/mounts.json",
+	EnvVars: []string{"S3VOL_STATEFILE"},
+	Usage:   "file keeping the mounts across restarts",
+}
+
+// withS3Flags adds the s3 flags to the provided flags
+func withS3Flags(flags ...cli.Flag) []cli.Flag {
+	return append(flags, s3Flags...)
+}
+
 func main() {
 	app := &cli.App{
 		Name:  "s3vol",
@@ -33,35 +195,7 @@ func main() {
 				Aliases: []string{"s"},
 				Usage:   "start s3vol server",
 				Action:  serve.Serve,
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:    "endpoint",
-						Aliases: []string{"e"},
-						Value:   "http://localhost:9000",
-						EnvVars: []string{"S3VOL_ENDPOINT"},
-						Usage:   "s3 endpoint",
-					},
-					&cli.StringFlag{
-						Name:     "accesskey",
-						Aliases:  []string{"k"},
-						Required: true,
-						EnvVars:  []string{"S3VOL_ACCESSKEY"},
-						Usage:    "s3 accesskey",
-					},
-					&cli.StringFlag{
-						Name:     "secretkey",
-						Aliases:  []string{"s"},
-						Required: true,
-						EnvVars:  []string{"S3VOL_SECRETKEY"},
-						Usage:    "s3 accesskey",
-					},
-					&cli.StringFlag{
-						Name:    "region",
-						Aliases: []string{"r"},
-						Value:   "us-east-1",
-						EnvVars: []string{"S3VOL_REGION"},
-						Usage:   "s3 region",
-					},
+				Flags: withS3Flags(
 					&cli.StringFlag{
 						Name:    "mount",
 						Aliases: []string{"m"},
@@ -76,27 +210,26 @@ func main() {
 						EnvVars: []string{"S3VOL_DEFAULTS"},
 						Usage:   "s3fs default options",
 					},
-					&cli.BoolFlag{
-						Name:    "replaceunderscores",
-						Aliases: []string{"u"},
-						Value:   true,
-						EnvVars: []string{"S3VOL_REPLACEUNDERSCORES"},
-						Usage:   "replace underscores by ---",
-					},
-					&cli.StringFlag{
-						Name:    "configbucket",
-						Aliases: []string{"b"},
-						Value:   "s3volconfig",
-						EnvVars: []string{"S3VOL_CONFIGBUCKET"},
-						Usage:   "bucket to store configuration",
-					},
 					&cli.StringFlag{
 						Name:    "s3fspath",
 						Value:   "",
 						EnvVars: []string{"S3VOL_S3FSPATH"},
 						Usage:   "path to s3fs command",
 					},
-				},
+					stateFlag,
+					&cli.StringFlag{
+						Name:    "passwd-dir",
+						Value:   "/run/s3vol/passwd",
+						EnvVars: []string{"S3VOL_PASSWDDIR"},
+						Usage:   "directory of the s3fs password files of volumes with their own credentials",
+					},
+					&cli.IntFlag{
+						Name:    "mount-timeout",
+						Value:   30,
+						EnvVars: []string{"S3VOL_MOUNTTIMEOUT"},
+						Usage:   "seconds a mounted volume has to be ready",
+					},
+				),
 			},
 			{
 				Name:    "volume",
@@ -105,12 +238,130 @@ func main() {
 				Subcommands: []*cli.Command{
 					{
 						Name:    "list",
-						Aliases: []string{"l"},
+						Aliases: []string{"l", "ls"},
 						Usage:   "list volumes",
+						Action:  volumes.List,
+						Flags: withS3Flags(
+							formatFlag,
+							&cli.BoolFlag{
+								Name:  "trash",
+								Usage: "list the removed volumes",
+							},
+						),
+					},
+					{
+						Name:      "inspect",
+						Aliases:   []string{"i"},
+						Usage:     "show volumes details",
+						ArgsUsage: "VOLUME [VOLUME...]",
+						Action:    volumes.Inspect,
+						Flags:     withS3Flags(formatFlag),
+					},
+					{
+						Name:      "create",
+						Aliases:   []string{"c"},
+						Usage:     "create a volume",
+						ArgsUsage: "VOLUME",
+						Action:    volumes.Create,
+						Flags: withS3Flags(
+							&cli.StringSliceFlag{
+								Name:    "opt",
+								Aliases: []string{"o"},
+								Usage:   "volume options (key=value)",
+							},
+							&cli.StringSliceFlag{
+								Name:    "label",
+								Aliases: []string{"l"},
+								Usage:   "volume labels (key=value)",
+							},
+						),
+					},
+					{
+						Name:      "rm",
+						Aliases:   []string{"remove"},
+						Usage:     "remove volumes",
+						ArgsUsage: "VOLUME [VOLUME...]",
+						Action:    volumes.Remove,
+						Flags: withS3Flags(
+							&cli.BoolFlag{
+								Name:  "purge",
+								Usage: "delete the data of buckets not created by s3vol",
+							},
+						),
+					},
+					{
+						Name:      "restore",
+						Usage:     "restore removed volumes from the trash",
+						ArgsUsage: "VOLUME [VOLUME...]",
+						Action:    volumes.Restore,
+						Flags:     withS3Flags(),
+					},
+					{
+						Name:    "snapshot",
+						Aliases: []string{"s"},
+						Usage:   "volume snapshot actions",
+						Subcommands: []*cli.Command{
+							{
+								Name:      "create",
+								Aliases:   []string{"c"},
+								Usage:     "snapshot volumes",
+								ArgsUsage: "VOLUME [VOLUME...]",
+								Action:    volumes.SnapshotCreate,
+								Flags:     withS3Flags(),
+							},
+							{
+								Name:      "list",
+								Aliases:   []string{"l", "ls"},
+								Usage:     "list snapshots",
+								ArgsUsage: "[VOLUME]",
+								Action:    volumes.SnapshotList,
+								Flags:     withS3Flags(formatFlag),
+							},
+							{
+								Name:      "restore",
+								Usage:     "replace the data of a volume with a snapshot",
+								ArgsUsage: "SNAPSHOT",
+								Action:    volumes.SnapshotRestore,
+								Flags:     withS3Flags(stateFlag),
+							},
+							{
+								Name:      "delete",
+								Aliases:   []string{"rm"},
+								Usage:     "delete snapshots",
+								ArgsUsage: "SNAPSHOT [SNAPSHOT...]",
+								Action:    volumes.SnapshotDelete,
+								Flags:     withS3Flags(),
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:  "lock",
+				Usage: "lock actions",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "inspect",
+						Aliases:   []string{"i", "ls"},
+						Usage:     "show locks of the config bucket",
+						ArgsUsage: "[OBJECT...]",
+						Action:    locks.Inspect,
+						Flags:     withS3Flags(formatFlag),
+					},
+					{
+						Name:      "break",
+						Usage:     "forcibly remove locks of the config bucket",
+						ArgsUsage: "OBJECT [OBJECT...]",
+						Action:    locks.Break,
+						Flags:     withS3Flags(),
 					},
 				},
 			},
 		},
 	}
-	app.Run(os.Args)
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,50 @@
+package driver
+
+import "fmt"
+
+const cloneOption = "clone"
+
+// splitClone separates the volume to clone from the volume options
+func splitClone(options map[string]string) (string, map[string]string, error) {
+	name, ok := options[cloneOption]
+	if !ok {
+		return "", options, nil
+	}
+	if err := validateVolumeName(name); err != nil {
+		return "", nil, err
+	}
+	opts := make(map[string]string)
+	for k, v := range options {
+		if k != cloneOption {
+			opts[k] = v
+		}
+	}
+	return name, opts, nil
+}
+
+// cloneSource gets the volume cloned by a new volume
+// the clone uses the connection of its source unless it has its own
+func (d *S3fsDriver) cloneSource(name string, volConfig *VolConfig) (*VolConfig, error) {
+	src, err := d.getVolumeConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	err = src.populated()
+	if err != nil {
+		return nil, err
+	}
+	if len(volConfig.Endpoint) == 0 && len(volConfig.Profile) == 0 && volConfig.Credentials == nil {
+		volConfig.Endpoint = src.Endpoint
+		volConfig.Profile = src.Profile
+		volConfig.Credentials = src.Credentials
+		if len(volConfig.Region) == 0 {
+			volConfig.Region = src.Region
+		}
+	}
+	// objects are copied server side
+	if d.volumeEndpoint(src) != d.volumeEndpoint(volConfig) {
+		return nil, fmt.Errorf("volume '%s' is not on the same endpoint", name)
+	}
+	volConfig.Origin = "volume:" + src.Name
+	return src, nil
+}
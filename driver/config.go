@@ -0,0 +1,240 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	configVersion      = 2
+	configPrefix       = "volumes/"
+	trashPrefix        = "trash/"
+	mountLocksPrefix   = "mounts/"
+	configExt          = ".json"
+	legacyConfigObject = "volumes.legacy"
+)
+
+//LabelPrefix is the prefix of volume options that are stored as labels
+const LabelPrefix = "label."
+
+// volumeObject is the document stored in the config object of a volume
+type volumeObject struct {
+	Version int `json:"version"`
+	VolConfig
+}
+
+// volumesConfig is the document formerly stored in the single config object (version 1)
+type volumesConfig struct {
+	Version int          `json:"version"`
+	Volumes []*VolConfig `json:"volumes"`
+}
+
+// volumeObjectName gets the name of the config object of a volume
+func volumeObjectName(volumeName string) string {
+	return fmt.Sprintf("%s%s%s", configPrefix, volumeName, configExt)
+}
+
+// trashObjectName gets the name of the config object of a removed volume
+func trashObjectName(volumeName string) string {
+	return fmt.Sprintf("%s%s%s", trashPrefix, volumeName, configExt)
+}
+
+// readVolumeConfig reads the config object of a volume
+func (d *S3fsDriver) readVolumeConfig(object string) (*VolConfig, error) {
+	obj, err := d.s3client.GetObject(d.ConfigBucketName, object, minio.GetObjectOptions{})
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not get config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return nil, fmt.Errorf("could not get config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	defer obj.Close()
+	config := &volumeObject{}
+	err = json.NewDecoder(obj).Decode(config)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil
+		}
+		log.WithField("command", "driver").Errorf("could not read config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return nil, fmt.Errorf("could not read config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	if config.Version > configVersion {
+		log.WithField("command", "driver").Errorf("config '%s' version %d is newer than supported version %d", object, config.Version, configVersion)
+		return nil, fmt.Errorf("config '%s' version %d is newer than supported version %d", object, config.Version, configVersion)
+	}
+	return &config.VolConfig, nil
+}
+
+// writeVolumeConfig writes the config object of a volume
+func (d *S3fsDriver) writeVolumeConfig(volConfig *VolConfig) error {
+	return d.writeConfigObject(volumeObjectName(volConfig.Name), volConfig)
+}
+
+// writeConfigObject writes a volume config to an object of the config bucket
+func (d *S3fsDriver) writeConfigObject(object string, volConfig *VolConfig) error {
+	data, err := json.MarshalIndent(&volumeObject{Version: configVersion, VolConfig: *volConfig}, "", "  ")
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not encode config '%s': %s", object, err)
+		return fmt.Errorf("could not encode config '%s': %s", object, err)
+	}
+	reader := bytes.NewReader(data)
+	_, err = d.s3client.PutObject(d.ConfigBucketName, object, reader, reader.Size(), minio.PutObjectOptions{ContentType: "application/json"})
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not write config '%s' to bucket '%s': %s", object, d.ConfigBucketName, err)
+		return fmt.Errorf("could not write config '%s' to bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	return nil
+}
+
+// parseLegacyConfig parses the semicolon delimited config (volumename;bucket;options)
+func parseLegacyConfig(data []byte) ([]*VolConfig, error) {
+	volConfigs := make([]*VolConfig, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		// skip comments and empty lines
+		if strings.HasPrefix(scanner.Text(), "#") || len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		// slit ";" and 3 max (volumename;bucket;options)
+		parts := strings.SplitN(scanner.Text(), ";", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("wrong line %d in config: %s", line, scanner.Text())
+		}
+		options, err := ParseOptions(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("wrong options on line %d in config for %s: %s", line, parts[0], err)
+		}
+		volConfigs = append(volConfigs, &VolConfig{Name: parts[0], Bucket: parts[1], Options: options})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return volConfigs, nil
+}
+
+// initConfig migrates the single config object to one config object per volume
+func (d *S3fsDriver) initConfig() error {
+	// check config object existance
+	_, err := d.s3client.StatObject(d.ConfigBucketName, configObject, minio.StatObjectOptions{})
+	if err != nil {
+		if code := minio.ToErrorResponse(err).Code; code == "NoSuchKey" || code == "NotFound" {
+			// nothing to migrate
+			return nil
+		}
+		log.WithField("command", "driver").Errorf("could not check config '%s' in bucket '%s': %s", configObject, d.ConfigBucketName, err)
+		return fmt.Errorf("could not check config '%s' in bucket '%s': %s", configObject, d.ConfigBucketName, err)
+	}
+	err = d.locker.Lock(configObject)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not lock config in %s: %s", d.ConfigBucketName, err)
+		return fmt.Errorf("could not lock config in %s: %s", d.ConfigBucketName, err)
+	}
+	defer d.locker.UnLock(configObject)
+	obj, err := d.s3client.GetObject(d.ConfigBucketName, configObject, minio.GetObjectOptions{})
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not get config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+		return fmt.Errorf("could not get config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+	}
+	defer obj.Close()
+	buf := bytes.Buffer{}
+	_, err = buf.ReadFrom(obj)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			// migrated by another host in the mean time
+			return nil
+		}
+		log.WithField("command", "driver").Errorf("could not read config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+		return fmt.Errorf("could not read config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+	}
+	var vols []*VolConfig
+	if strings.HasPrefix(strings.TrimSpace(buf.String()), "{") {
+		// structured config (version 1)
+		log.WithField("command", "driver").Infof("migrating config '%s' from a single document", configObject)
+		config := &volumesConfig{}
+		err = json.Unmarshal(buf.Bytes(), config)
+		if err != nil {
+			log.WithField("command", "driver").Errorf("could not migrate config '%s': %s", configObject, err)
+			return fmt.Errorf("could not migrate config '%s': %s", configObject, err)
+		}
+		vols = config.Volumes
+	} else {
+		log.WithField("command", "driver").Infof("migrating config '%s' from legacy format", configObject)
+		vols, err = parseLegacyConfig(buf.Bytes())
+		if err != nil {
+			log.WithField("command", "driver").Errorf("could not migrate config '%s': %s", configObject, err)
+			return fmt.Errorf("could not migrate config '%s': %s", configObject, err)
+		}
+		// use the bucket creation date as volume creation date
+		bucketInfos, err := d.s3client.ListBuckets()
+		if err != nil {
+			log.WithField("command", "driver").Errorf("could not get bucket infos: %s", err)
+			return fmt.Errorf("could not get bucket infos: %s", err)
+		}
+		for _, v := range vols {
+			for _, b := range bucketInfos {
+				if v.Bucket == b.Name {
+					v.CreatedAt = b.CreationDate.UTC()
+					break
+				}
+			}
+		}
+	}
+	for _, v := range vols {
+		// don't overwrite volumes created since
+		existing, err := d.readVolumeConfig(volumeObjectName(v.Name))
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			log.WithField("command", "driver").Warnf("volume '%s' already has a config object, skipping", v.Name)
+			continue
+		}
+		err = d.writeVolumeConfig(v)
+		if err != nil {
+			return err
+		}
+	}
+	// keep a copy of the former config
+	reader := bytes.NewReader(buf.Bytes())
+	_, err = d.s3client.PutObject(d.ConfigBucketName, legacyConfigObject, reader, reader.Size(), minio.PutObjectOptions{})
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not backup config to '%s': %s", legacyConfigObject, err)
+		return fmt.Errorf("could not backup config to '%s': %s", legacyConfigObject, err)
+	}
+	err = d.s3client.RemoveObject(d.ConfigBucketName, configObject)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not remove config '%s': %s", configObject, err)
+		return fmt.Errorf("could not remove config '%s': %s", configObject, err)
+	}
+	log.WithField("command", "driver").Infof("migrated %d volumes, former config saved as '%s'", len(vols), legacyConfigObject)
+	return nil
+}
+
+// splitLabels separates the labels (label.key=value) from the volume options
+func splitLabels(options map[string]string) (map[string]string, map[string]string) {
+	opts := make(map[string]string)
+	labels := make(map[string]string)
+	for k, v := range options {
+		if strings.HasPrefix(k, LabelPrefix) {
+			labels[strings.TrimPrefix(k, LabelPrefix)] = v
+			continue
+		}
+		opts[k] = v
+	}
+	return opts, labels
+}
+
+// createdAt formats the creation date of a volume
+func (v *VolConfig) createdAt() string {
+	if v.CreatedAt.IsZero() {
+		return ""
+	}
+	return v.CreatedAt.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,354 @@
+package driver
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+)
+
+func TestParseLegacyConfig(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected []*VolConfig
+		err      string
+	}{
+		{"", []*VolConfig{}, ""},
+		{"# volumes\n\n  \n", []*VolConfig{}, ""},
+		{
+			"vol1;bucket1;\nvol2;bucket2;allow_other,uid=1000,nonempty=false\n",
+			[]*VolConfig{
+				{Name: "vol1", Bucket: "bucket1", Options: map[string]string{}},
+				{Name: "vol2", Bucket: "bucket2", Options: map[string]string{"allow_other": "true", "uid": "1000"}},
+			},
+			"",
+		},
+		{
+			"vol1;bucket1;label.env=a;b\r\n",
+			[]*VolConfig{{Name: "vol1", Bucket: "bucket1", Options: map[string]string{"label.env": "a;b"}}},
+			"",
+		},
+		{"vol1;bucket1;\nvol2\n", nil, "wrong line 2"},
+		{"vol1;bucket1\n", nil, "wrong line 1"},
+	}
+	for _, test := range tests {
+		vols, err := parseLegacyConfig([]byte(test.config))
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseLegacyConfig(%q) = %v, expected %q", test.config, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLegacyConfig(%q) failed: %s", test.config, err)
+			continue
+		}
+		if !reflect.DeepEqual(vols, test.expected) {
+			t.Errorf("parseLegacyConfig(%q) = %s, expected %s", test.config, dumpVolConfigs(vols), dumpVolConfigs(test.expected))
+		}
+	}
+}
+
+// dumpVolConfigs formats volume configs for the test messages
+func dumpVolConfigs(vols []*VolConfig) string {
+	data, _ := json.Marshal(vols)
+	return string(data)
+}
+
+// s3Stub is an s3 endpoint keeping the objects and buckets in memory
+type s3Stub struct {
+	sync.Mutex
+	objects map[string][]byte
+	buckets map[string]time.Time
+	// failures are the status codes returned for objects
+	failures map[string]int
+	// unconditional rejects conditional writes as not implemented
+	unconditional bool
+	// conditions are the conditional headers of the writes
+	conditions []string
+}
+
+// stubETag is the etag of an object of the stub
+func stubETag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(data))
+}
+
+// precondition checks the conditional headers of a write, returns the failure status
+func (s *s3Stub) precondition(r *http.Request, key string) int {
+	noneMatch := r.Header.Get("If-None-Match")
+	match := r.Header.Get("If-Match")
+	if len(noneMatch) == 0 && len(match) == 0 {
+		return 0
+	}
+	if s.unconditional {
+		return http.StatusNotImplemented
+	}
+	data, ok := s.objects[key]
+	if len(noneMatch) > 0 {
+		s.conditions = append(s.conditions, "If-None-Match: "+noneMatch)
+		if noneMatch == "*" && ok {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if len(match) > 0 {
+		s.conditions = append(s.conditions, "If-Match: "+match)
+		if !ok || strings.Trim(match, `"`) != strings.Trim(stubETag(data), `"`) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	return 0
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.URL.Path == "/" {
+		fmt.Fprint(w, `<ListAllMyBucketsResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Buckets>`)
+		for name, created := range s.buckets {
+			fmt.Fprintf(w, "<Bucket><Name>%s</Name><CreationDate>%s</CreationDate></Bucket>", name, created.Format(time.RFC3339))
+		}
+		fmt.Fprint(w, `</Buckets></ListAllMyBucketsResult>`)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if status, ok := s.failures[key]; ok {
+		w.WriteHeader(status)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		s.list(w, strings.TrimSuffix(key, "/"), r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+		return
+	case r.Method == http.MethodPut && len(r.Header.Get("X-Amz-Copy-Source")) > 0:
+		source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, ok := s.objects[strings.TrimPrefix(source, "/")]
+		if !ok {
+			http.Error(w, "no such source", http.StatusNotFound)
+			return
+		}
+		s.objects[key] = append([]byte{}, data...)
+		fmt.Fprintf(w, `<CopyObjectResult><LastModified>%s</LastModified><ETag>"etag"</ETag></CopyObjectResult>`, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch s.precondition(r, key) {
+		case http.StatusPreconditionFailed:
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprintf(w, `<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message><Key>%s</Key></Error>`, key)
+			return
+		case http.StatusNotImplemented:
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotImplemented)
+			fmt.Fprintf(w, `<Error><Code>NotImplemented</Code><Message>A header you provided implies functionality that is not implemented</Message><Key>%s</Key></Error>`, key)
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", stubETag(data))
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message><Key>%s</Key></Error>`, key)
+			}
+			return
+		}
+		w.Header().Set("ETag", stubETag(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+// list writes the objects of a bucket under a prefix, grouped by delimiter
+func (s *s3Stub) list(w http.ResponseWriter, bucket string, prefix string, delimiter string) {
+	keys := make([]string, 0)
+	prefixes := make(map[string]bool)
+	for k := range s.objects {
+		if !strings.HasPrefix(k, bucket+"/"+prefix) {
+			continue
+		}
+		key := strings.TrimPrefix(k, bucket+"/")
+		if len(delimiter) > 0 {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				prefixes[key[:len(prefix)+i+len(delimiter)]] = true
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>%s</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated>`, bucket, prefix)
+	for _, key := range keys {
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>"etag"</ETag><Size>%d</Size></Contents>`, key, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), len(s.objects[bucket+"/"+key]))
+	}
+	for p := range prefixes {
+		fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, p)
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+// readS3Body reads the body of an s3 request, signed by chunks over http
+func readS3Body(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return ioutil.ReadAll(r.Body)
+	}
+	// <size in hex>;chunk-signature=<signature>\r\n<data>\r\n up to an empty chunk
+	reader := bufio.NewReader(r.Body)
+	data := make([]byte, 0)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(header, ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(reader, chunk)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+// newConfigDriver gets a driver using an s3 stub for its config bucket
+func newConfigDriver(t *testing.T, stub *s3Stub) *S3fsDriver {
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+	clt, err := minio.NewWithRegion(strings.TrimPrefix(srv.URL, "http://"), "a", "b", false, "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "s3vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	locker, err := newFileLocker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &S3fsDriver{ConfigBucketName: "s3vol", s3client: clt, locker: locker}
+}
+
+func TestInitConfig(t *testing.T) {
+	created := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	legacy := "# volumes\nvol1;bucket1;allow_other,uid=1000\nvol2;bucket2;\n"
+	existing := `{"version":2,"name":"vol2","bucket":"other"}`
+	stub := &s3Stub{
+		objects: map[string][]byte{
+			"s3vol/" + configObject:             []byte(legacy),
+			"s3vol/" + volumeObjectName("vol2"): []byte(existing),
+		},
+		buckets: map[string]time.Time{"bucket1": created},
+	}
+	d := newConfigDriver(t, stub)
+	err := d.initConfig()
+	if err != nil {
+		t.Fatalf("could not migrate config: %s", err)
+	}
+	vol1, err := d.readVolumeConfig(volumeObjectName("vol1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &VolConfig{Name: "vol1", Bucket: "bucket1", Options: map[string]string{"allow_other": "true", "uid": "1000"}, CreatedAt: created}
+	if vol1 == nil || !reflect.DeepEqual(vol1, expected) {
+		t.Errorf("unexpected migrated config %s, expected %s", dumpVolConfigs([]*VolConfig{vol1}), dumpVolConfigs([]*VolConfig{expected}))
+	}
+	// volumes created since are kept
+	if string(stub.objects["s3vol/"+volumeObjectName("vol2")]) != existing {
+		t.Errorf("existing config overwritten: %s", stub.objects["s3vol/"+volumeObjectName("vol2")])
+	}
+	if _, ok := stub.objects["s3vol/"+configObject]; ok {
+		t.Errorf("legacy config not removed")
+	}
+	if string(stub.objects["s3vol/"+legacyConfigObject]) != legacy {
+		t.Errorf("legacy config not kept: %s", stub.objects["s3vol/"+legacyConfigObject])
+	}
+	// nothing left to migrate
+	err = d.initConfig()
+	if err != nil {
+		t.Errorf("could not run the migration again: %s", err)
+	}
+}
+
+func TestInitConfigVersion1(t *testing.T) {
+	config := `{"version":1,"volumes":[{"name":"vol1","bucket":"bucket1","options":{"uid":"1000"}}]}`
+	stub := &s3Stub{
+		objects: map[string][]byte{"s3vol/" + configObject: []byte(config)},
+		buckets: map[string]time.Time{},
+	}
+	d := newConfigDriver(t, stub)
+	err := d.initConfig()
+	if err != nil {
+		t.Fatalf("could not migrate config: %s", err)
+	}
+	data := stub.objects["s3vol/"+volumeObjectName("vol1")]
+	doc := &volumeObject{}
+	err = json.Unmarshal(data, doc)
+	if err != nil {
+		t.Fatalf("could not read migrated config %s: %s", data, err)
+	}
+	if doc.Version != configVersion || doc.Name != "vol1" || doc.Bucket != "bucket1" || doc.Options["uid"] != "1000" {
+		t.Errorf("unexpected migrated config %s", data)
+	}
+}
+
+func TestInitConfigUnreadable(t *testing.T) {
+	stub := &s3Stub{
+		objects:  map[string][]byte{},
+		buckets:  map[string]time.Time{},
+		failures: map[string]int{"s3vol/" + configObject: http.StatusForbidden},
+	}
+	d := newConfigDriver(t, stub)
+	err := d.initConfig()
+	if err == nil || !strings.Contains(err.Error(), "could not check config") {
+		t.Errorf("unexpected error with an unreadable legacy config: %v", err)
+	}
+	// a missing legacy config is nothing to migrate
+	delete(stub.failures, "s3vol/"+configObject)
+	err = d.initConfig()
+	if err != nil {
+		t.Errorf("unexpected error without a legacy config: %s", err)
+	}
+}
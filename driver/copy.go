@@ -0,0 +1,273 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	copyWorkers  = 8
+	copyProgress = 10 * time.Second
+	// copyMaxSize is the largest object copied in a single request
+	copyMaxSize = 5 << 30
+	// populateHeartbeat is the delay between the updates of a volume being populated
+	populateHeartbeat = 30 * time.Second
+	// populateStale is the delay after which a volume not updated is not being populated anymore
+	populateStale = 2 * time.Minute
+)
+
+// copyStats counts the copied objects
+type copyStats struct {
+	objects int64
+	size    int64
+}
+
+// copyObject copies an object server side
+func copyObject(clt *minio.Client, srcBucket string, srcKey string, size int64, dstBucket string, dstKey string) error {
+	dst, err := minio.NewDestinationInfo(dstBucket, dstKey, nil, nil)
+	if err != nil {
+		return err
+	}
+	src := minio.NewSourceInfo(srcBucket, srcKey, nil)
+	if size > copyMaxSize {
+		// multipart copy
+		return clt.ComposeObject(dst, []minio.SourceInfo{src})
+	}
+	return clt.CopyObject(dst, src)
+}
+
+// copyObjects copies server side the objects under a prefix to a prefix of another bucket
+func (d *S3fsDriver) copyObjects(clt *minio.Client, srcBucket string, srcPrefix string, dstBucket string, dstPrefix string) (*copyStats, error) {
+	source := fmt.Sprintf("%s/%s", srcBucket, srcPrefix)
+	destination := fmt.Sprintf("%s/%s", dstBucket, dstPrefix)
+	log.WithField("command", "driver").WithField("method", "copy").Infof("copying %s to %s", source, destination)
+	errs := &errorList{}
+	stats := &copyStats{}
+	objects := make(chan minio.ObjectInfo)
+	var wg sync.WaitGroup
+	for i := 0; i < copyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for object := range objects {
+				key := dstPrefix + strings.TrimPrefix(object.Key, srcPrefix)
+				object := object
+				err := retry(func() error {
+					return copyObject(clt, srcBucket, object.Key, object.Size, dstBucket, key)
+				})
+				if err != nil {
+					errs.add(fmt.Errorf("could not copy %s: %s", object.Key, err))
+					continue
+				}
+				atomic.AddInt64(&stats.objects, 1)
+				atomic.AddInt64(&stats.size, object.Size)
+			}
+		}()
+	}
+	// report progress while copying
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(copyProgress)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.WithField("command", "driver").WithField("method", "copy").Infof("copying %s: %d objects (%d bytes) copied", source, atomic.LoadInt64(&stats.objects), atomic.LoadInt64(&stats.size))
+			case <-done:
+				return
+			}
+		}
+	}()
+	doneCh := make(chan struct{})
+	for object := range clt.ListObjectsV2(srcBucket, srcPrefix, true, doneCh) {
+		if object.Err != nil {
+			errs.add(fmt.Errorf("could not list objects of %s: %s", source, object.Err))
+			break
+		}
+		// the directory of a prefix and the removal flag are not data
+		if object.Key == srcPrefix || strings.HasSuffix(object.Key, "/"+trashMarker) || object.Key == trashMarker {
+			continue
+		}
+		objects <- object
+	}
+	close(doneCh)
+	close(objects)
+	wg.Wait()
+	close(done)
+	err := errs.err(fmt.Sprintf("copying %s to %s", source, destination))
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "copy").Errorf("%s", err)
+		return stats, err
+	}
+	log.WithField("command", "driver").WithField("method", "copy").Infof("copied %s to %s: %d objects (%d bytes)", source, destination, stats.objects, stats.size)
+	return stats, nil
+}
+
+// populated checks that the data of a volume has been copied
+func (v *VolConfig) populated() error {
+	if !v.Populating {
+		return nil
+	}
+	if v.populateInterrupted() {
+		return fmt.Errorf("volume '%s' was not populated: copy interrupted by %s, remove it", v.Name, v.PopulateOwner)
+	}
+	return fmt.Errorf("volume '%s' is being populated by %s", v.Name, v.PopulateOwner)
+}
+
+// populateInterrupted checks if the copy to a volume stopped without updating it
+func (v *VolConfig) populateInterrupted() bool {
+	if !v.Populating {
+		return false
+	}
+	updated := v.CreatedAt
+	if v.PopulateUpdated != nil {
+		updated = *v.PopulateUpdated
+	}
+	return time.Since(updated) > populateStale
+}
+
+// populateVolume copies data to a new volume with fill
+// the volume is usable once its data is copied, it is removed with its data if the copy fails
+func (d *S3fsDriver) populateVolume(volConfig *VolConfig, fill func() error) error {
+	// never overwrite data the driver doesn't own
+	err := fmt.Errorf("volume '%s' can only be populated in a new bucket or prefix", volConfig.Name)
+	if volConfig.Owned {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go d.populateAlive(volConfig.Name, volConfig.PopulateOwner, stop, stopped)
+		err = fill()
+		close(stop)
+		<-stopped
+	}
+	if err == nil {
+		err = d.populatedVolume(volConfig)
+	}
+	if err == nil {
+		return nil
+	}
+	log.WithField("command", "driver").WithField("method", "create").Errorf("could not populate volume '%s': %s", volConfig.Name, err)
+	d.removePopulating(volConfig)
+	return fmt.Errorf("could not populate volume '%s': %s", volConfig.Name, err)
+}
+
+// removePopulating removes a volume that could not be populated and the data already copied
+func (d *S3fsDriver) removePopulating(volConfig *VolConfig) {
+	if volConfig.Owned {
+		if err := d.deleteData(volConfig); err != nil {
+			log.WithField("command", "driver").WithField("method", "create").Warnf("could not remove data of volume '%s': %s", volConfig.Name, err)
+		}
+	}
+	if err := d.removeVolume(volConfig); err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Warnf("could not remove volume '%s': %s", volConfig.Name, err)
+	}
+}
+
+// populateAlive updates a volume while its data is copied so that other hosts know the copy goes on
+func (d *S3fsDriver) populateAlive(volumeName string, owner *LockOwner, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(populateHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		err := d.touchPopulating(volumeName, owner)
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "create").Warnf("could not update volume '%s' being populated: %s", volumeName, err)
+		}
+	}
+}
+
+// touchPopulating updates the time of a volume being populated by owner
+func (d *S3fsDriver) touchPopulating(volumeName string, owner *LockOwner) error {
+	object := volumeObjectName(volumeName)
+	err := d.locker.Lock(object)
+	if err != nil {
+		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	defer d.locker.UnLock(object)
+	volConfig, err := d.readVolumeConfig(object)
+	if err != nil {
+		return err
+	}
+	if volConfig == nil || !volConfig.Populating || volConfig.PopulateOwner == nil || !volConfig.PopulateOwner.same(owner) {
+		return fmt.Errorf("volume not populated by this process anymore")
+	}
+	now := time.Now().UTC()
+	volConfig.PopulateUpdated = &now
+	return d.writeVolumeConfig(volConfig)
+}
+
+// populatedVolume clears the populating state of a volume
+func (d *S3fsDriver) populatedVolume(volConfig *VolConfig) error {
+	object := volumeObjectName(volConfig.Name)
+	err := d.locker.Lock(object)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	defer d.locker.UnLock(object)
+	volConfig.Populating = false
+	volConfig.PopulateOwner = nil
+	volConfig.PopulateUpdated = nil
+	return d.writeVolumeConfig(volConfig)
+}
+
+// checkPopulating fails the create of a volume being populated
+// the volume is removed if its copy was interrupted so that the create can be retried
+func (d *S3fsDriver) checkPopulating(volumeName string) error {
+	volConfig, err := d.readVolumeConfig(volumeObjectName(volumeName))
+	if err != nil {
+		return err
+	}
+	if volConfig == nil || !volConfig.Populating {
+		return nil
+	}
+	if d.failPopulating(volConfig) {
+		return fmt.Errorf("volume '%s' was not populated: copy interrupted by %s, its data was removed, create it again", volumeName, volConfig.PopulateOwner)
+	}
+	return volConfig.populated()
+}
+
+// failInterrupted removes the volumes whose copy was interrupted
+func (d *S3fsDriver) failInterrupted() {
+	vols, err := d.getVolumesConfig()
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "populate").Errorf("could not get volumes config: %s", err)
+		return
+	}
+	for _, v := range vols {
+		if d.failPopulating(v) {
+			log.WithField("command", "driver").WithField("method", "populate").Warnf("removed volume '%s': copy interrupted by %s", v.Name, v.PopulateOwner)
+		}
+	}
+}
+
+// failPopulating removes a volume if its copy was interrupted and tells if it was
+func (d *S3fsDriver) failPopulating(volConfig *VolConfig) bool {
+	if !volConfig.populateInterrupted() {
+		return false
+	}
+	// check again once locked: the copy could have ended meanwhile
+	object := volumeObjectName(volConfig.Name)
+	err := d.locker.Lock(object)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "populate").Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return false
+	}
+	current, err := d.readVolumeConfig(object)
+	d.locker.UnLock(object)
+	if err != nil || current == nil || !current.populateInterrupted() {
+		return false
+	}
+	d.removePopulating(current)
+	return true
+}
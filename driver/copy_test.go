@@ -0,0 +1,72 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailInterrupted(t *testing.T) {
+	stub := &s3Stub{objects: map[string][]byte{}, buckets: map[string]time.Time{}}
+	d := newConfigDriver(t, stub)
+	owner := &LockOwner{Hostname: "host1", PID: 42, Started: time.Now().UTC(), Nonce: "n"}
+	stale := time.Now().UTC().Add(-2 * populateStale)
+	alive := time.Now().UTC()
+	vols := []*VolConfig{
+		{Name: "done", Bucket: "done", CreatedAt: stale},
+		{Name: "copying", Bucket: "copying", CreatedAt: stale, Populating: true, PopulateOwner: owner, PopulateUpdated: &alive},
+		{Name: "crashed", Bucket: "crashed", CreatedAt: stale, Populating: true, PopulateOwner: owner, PopulateUpdated: &stale},
+		{Name: "legacy", Bucket: "legacy", CreatedAt: stale, Populating: true},
+	}
+	for _, v := range vols {
+		err := d.writeVolumeConfig(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a retried create tells who copies the data
+	err := d.checkPopulating("copying")
+	if err == nil || !strings.Contains(err.Error(), "is being populated by host1[42]") {
+		t.Errorf("unexpected error creating a volume being populated: %v", err)
+	}
+	err = d.checkPopulating("done")
+	if err != nil {
+		t.Errorf("unexpected error creating an existing volume: %s", err)
+	}
+	err = d.checkPopulating("crashed")
+	if err == nil || !strings.Contains(err.Error(), "copy interrupted by host1[42]") {
+		t.Errorf("unexpected error creating a volume whose copy was interrupted: %v", err)
+	}
+	d.failInterrupted()
+	for _, test := range []struct {
+		name string
+		kept bool
+	}{
+		{"done", true},
+		{"copying", true},
+		{"crashed", false},
+		{"legacy", false},
+	} {
+		_, ok := stub.objects["s3vol/"+volumeObjectName(test.name)]
+		if ok != test.kept {
+			t.Errorf("volume %s kept: %v, expected %v", test.name, ok, test.kept)
+		}
+	}
+	// the copy ends with an up to date volume
+	copying, err := d.getVolumeConfig("copying")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copying.Owned = true
+	err = d.populateVolume(copying, func() error { return nil })
+	if err != nil {
+		t.Fatalf("could not populate volume: %s", err)
+	}
+	copying, err = d.getVolumeConfig("copying")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copying.Populating || copying.PopulateOwner != nil || copying.PopulateUpdated != nil || copying.populated() != nil {
+		t.Errorf("volume still populating after its copy: %s", dumpVolConfigs([]*VolConfig{copying}))
+	}
+}
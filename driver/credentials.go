@@ -0,0 +1,383 @@
+package driver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	accessKeyOption = "accesskey"
+	secretKeyOption = "secretkey"
+	encryptedPrefix = "aesgcm:"
+)
+
+//VolCredentials are the s3 credentials of a volume (the secret key is encrypted)
+type VolCredentials struct {
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+}
+
+// configKey derives the key encrypting the secrets in the config bucket (none without a passphrase)
+func configKey(key string) []byte {
+	if len(key) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// legacyConfigKey derives the key formerly used without a config key from the s3 secret key
+// it only decrypts the secrets stored by older versions: it changes with the secret key
+func legacyConfigKey(secretkey string) []byte {
+	if len(secretkey) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256([]byte("s3vol:" + secretkey))
+	return sum[:]
+}
+
+// errNoConfigKey is returned when secrets are stored without a config key
+var errNoConfigKey = fmt.Errorf("no config key to encrypt the volume secrets: set --config-key")
+
+// encryptSecret encrypts a secret with the config key
+func (d *S3fsDriver) encryptSecret(secret string) (string, error) {
+	if len(d.configKey) == 0 {
+		return "", errNoConfigKey
+	}
+	block, err := aes.NewCipher(d.configKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret decrypts a sealed secret with a key
+func openSecret(key []byte, sealed []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted secret too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// decryptSecret decrypts a secret with the config key or the legacy key (unencrypted secrets are returned as is)
+// it tells if the secret was encrypted with the legacy key
+func (d *S3fsDriver) decryptSecret(secret string) (string, bool, error) {
+	if !strings.HasPrefix(secret, encryptedPrefix) {
+		return secret, false, nil
+	}
+	if len(d.configKey) == 0 && len(d.legacyConfigKey) == 0 {
+		return "", false, errNoConfigKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, encryptedPrefix))
+	if err != nil {
+		return "", false, err
+	}
+	if len(d.configKey) > 0 {
+		plain, err := openSecret(d.configKey, sealed)
+		if err == nil {
+			return plain, false, nil
+		}
+	}
+	if len(d.legacyConfigKey) > 0 {
+		plain, err := openSecret(d.legacyConfigKey, sealed)
+		if err == nil {
+			return plain, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("could not decrypt secret: wrong config key or secret key changed")
+}
+
+// rekeySecrets encrypts again with the config key the volume secrets encrypted with the legacy key
+func (d *S3fsDriver) rekeySecrets() error {
+	if len(d.configKey) == 0 || len(d.legacyConfigKey) == 0 {
+		return nil
+	}
+	vols, err := d.getVolumesConfig()
+	if err != nil {
+		return err
+	}
+	trash, err := d.TrashConfigs()
+	if err != nil {
+		return err
+	}
+	objects := make(map[string]*VolConfig)
+	for _, v := range vols {
+		objects[volumeObjectName(v.Name)] = v
+	}
+	for _, v := range trash {
+		objects[trashObjectName(v.Name)] = v
+	}
+	for object, v := range objects {
+		if v.Credentials == nil {
+			continue
+		}
+		_, legacy, err := d.decryptSecret(v.Credentials.SecretKey)
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "rekey").Warnf("could not decrypt secret of volume %s: %s", v.Name, err)
+			continue
+		}
+		if !legacy {
+			continue
+		}
+		err = d.rekeySecret(object)
+		if err != nil {
+			return err
+		}
+		log.WithField("command", "driver").WithField("method", "rekey").Infof("secret of volume %s encrypted with the config key", v.Name)
+	}
+	return nil
+}
+
+// rekeySecret encrypts again the secret of a config object with the config key
+func (d *S3fsDriver) rekeySecret(object string) error {
+	err := d.locker.Lock(object)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "rekey").Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	defer d.locker.UnLock(object)
+	// changed since listed
+	volConfig, err := d.readVolumeConfig(object)
+	if err != nil || volConfig == nil || volConfig.Credentials == nil {
+		return err
+	}
+	secret, legacy, err := d.decryptSecret(volConfig.Credentials.SecretKey)
+	if err != nil || !legacy {
+		return err
+	}
+	volConfig.Credentials.SecretKey, err = d.encryptSecret(secret)
+	if err != nil {
+		return err
+	}
+	err = d.writeConfigObject(object, volConfig)
+	if err != nil {
+		return err
+	}
+	return d.locker.Held(object)
+}
+
+// splitCredentials separates the credentials from the volume options and encrypts the secret
+func (d *S3fsDriver) splitCredentials(options map[string]string) (*VolCredentials, map[string]string, error) {
+	accesskey, hasAccess := options[accessKeyOption]
+	secretkey, hasSecret := options[secretKeyOption]
+	if !hasAccess && !hasSecret {
+		return nil, options, nil
+	}
+	if len(accesskey) == 0 || len(secretkey) == 0 {
+		return nil, nil, fmt.Errorf("both %s and %s options are needed", accessKeyOption, secretKeyOption)
+	}
+	// the secrets must outlive the driver secret key
+	if len(d.configKey) == 0 {
+		return nil, nil, errNoConfigKey
+	}
+	opts := make(map[string]string)
+	for k, v := range options {
+		if k != accessKeyOption && k != secretKeyOption {
+			opts[k] = v
+		}
+	}
+	encrypted, err := d.encryptSecret(secretkey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not encrypt secret key: %s", err)
+	}
+	return &VolCredentials{AccessKey: accesskey, SecretKey: encrypted}, opts, nil
+}
+
+// volumeAuth is the s3 connection of a volume
+type volumeAuth struct {
+	// key identifies the credentials in the clients cache (empty for the driver ones)
+	key          string
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// volumeAuth gets the s3 connection of a volume: its profile, its own credentials or the driver ones
+// the endpoint and region of the volume have precedence
+func (d *S3fsDriver) volumeAuth(volConfig *VolConfig) (*volumeAuth, error) {
+	var auth *volumeAuth
+	switch {
+	case len(volConfig.Profile) > 0:
+		p, err := d.profile(volConfig.Profile)
+		if err != nil {
+			return nil, err
+		}
+		auth = &volumeAuth{key: "profile:" + p.Name, endpoint: p.Endpoint, region: p.Region, accessKey: p.AccessKey, secretKey: p.SecretKey, sessionToken: p.SessionToken}
+	case volConfig.Credentials != nil:
+		secretkey, _, err := d.decryptSecret(volConfig.Credentials.SecretKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not get secret key: %s", err)
+		}
+		auth = &volumeAuth{key: "key:" + volConfig.Credentials.AccessKey, accessKey: volConfig.Credentials.AccessKey, secretKey: secretkey}
+	default:
+		err := d.checkEndpointAuth(volConfig)
+		if err != nil {
+			return nil, err
+		}
+		// the driver credentials may be temporary
+		v, err := d.creds.Get()
+		if err != nil {
+			return nil, fmt.Errorf("could not get driver credentials: %s", err)
+		}
+		auth = &volumeAuth{accessKey: v.AccessKeyID, secretKey: v.SecretAccessKey, sessionToken: v.SessionToken}
+	}
+	if len(volConfig.Endpoint) > 0 {
+		auth.endpoint = volConfig.Endpoint
+	}
+	if len(volConfig.Region) > 0 {
+		auth.region = volConfig.Region
+	}
+	return auth, nil
+}
+
+// passwdFile gets the path of the s3fs password file of a volume
+func (d *S3fsDriver) passwdFile(volumeName string) string {
+	return filepath.Join(d.PasswdDir, volumeName)
+}
+
+// writePasswdFile writes the s3fs password file of a volume with its own credentials
+func (d *S3fsDriver) writePasswdFile(volumeName string, auth *volumeAuth) (string, error) {
+	err := os.MkdirAll(d.PasswdDir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("could not create password directory: %s", err)
+	}
+	path := d.passwdFile(volumeName)
+	err = ioutil.WriteFile(path, []byte(fmt.Sprintf("%s:%s", auth.accessKey, auth.secretKey)), 0600)
+	if err != nil {
+		return "", fmt.Errorf("could not write password file: %s", err)
+	}
+	// s3fs refuses password files readable by others
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		return "", fmt.Errorf("could not set password file permissions: %s", err)
+	}
+	return path, nil
+}
+
+// volumeConnection sets the s3fs connection options of a volume
+// it returns the environment of s3fs and if the credentials are rotated with the driver ones
+func (d *S3fsDriver) volumeConnection(volConfig *VolConfig, options map[string]string) ([]string, bool, error) {
+	auth, err := d.volumeAuth(volConfig)
+	if err != nil {
+		return nil, false, err
+	}
+	// s3fs calls the region endpoint
+	if len(auth.endpoint) > 0 {
+		options["url"] = auth.endpoint
+	}
+	if len(auth.region) > 0 {
+		options["endpoint"] = auth.region
+	}
+	rotate := false
+	if volConfig.Credentials == nil && len(volConfig.Profile) == 0 {
+		switch {
+		case d.s3fsIAM:
+			// s3fs gets and refreshes the role credentials
+			options["iam_role"] = "auto"
+			if len(os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")) > 0 {
+				options["ecs"] = "true"
+			}
+			return nil, false, nil
+		case d.CredentialsSource != credentialsIAM && len(d.SessionToken) == 0:
+			// s3fs uses the global password file
+			return nil, false, nil
+		}
+		rotate = d.CredentialsSource == credentialsIAM
+		if rotate {
+			log.WithField("command", "driver").WithField("method", "mount").Warnf("s3fs of volume %s only reads the driver temporary credentials when it starts: it fails once they expire", volConfig.Name)
+		}
+	}
+	// session tokens only fit in an aws credentials file
+	if len(auth.sessionToken) > 0 {
+		home, err := d.writeAWSCredentials(volConfig.Name, auth)
+		if err != nil {
+			return nil, false, err
+		}
+		return []string{"HOME=" + home}, rotate, nil
+	}
+	passwd, err := d.writePasswdFile(volConfig.Name, auth)
+	if err != nil {
+		return nil, false, err
+	}
+	options["passwd_file"] = passwd
+	return nil, false, nil
+}
+
+// awsConnection sets the connection of the backends using the aws sdk credentials chain
+// it returns if the credentials are rotated with the driver ones
+func (d *S3fsDriver) awsConnection(volConfig *VolConfig, spec *mountSpec) (bool, error) {
+	auth, err := d.volumeAuth(volConfig)
+	if err != nil {
+		return false, err
+	}
+	spec.endpoint = d.endpointURL()
+	if len(auth.endpoint) > 0 {
+		spec.endpoint = auth.endpoint
+	}
+	spec.region = d.Region
+	if len(auth.region) > 0 {
+		spec.region = auth.region
+	}
+	rotate := volConfig.Credentials == nil && len(volConfig.Profile) == 0 && d.CredentialsSource == credentialsIAM
+	if rotate && d.s3fsIAM {
+		// the sdk gets the role credentials from the metadata service
+		return false, nil
+	}
+	write := d.writeAWSCredentials
+	if rotate {
+		// the sdk reads the rotated credentials when they expire
+		write = d.writeProcessCredentials
+	}
+	home, err := write(volConfig.Name, auth)
+	if err != nil {
+		return false, err
+	}
+	spec.env = append(spec.env, "HOME="+home, "AWS_SHARED_CREDENTIALS_FILE="+filepath.Join(home, ".aws", "credentials"))
+	return rotate, nil
+}
+
+// removePasswdFile removes the s3fs password file of a volume
+func (d *S3fsDriver) removePasswdFile(volumeName string) {
+	err := os.Remove(d.passwdFile(volumeName))
+	if err != nil && !os.IsNotExist(err) {
+		log.WithField("command", "driver").Warnf("could not remove password file of volume %s: %s", volumeName, err)
+	}
+	err = os.RemoveAll(d.credentialsHome(volumeName))
+	if err != nil {
+		log.WithField("command", "driver").Warnf("could not remove credentials file of volume %s: %s", volumeName, err)
+	}
+}
@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v6"
+)
+
+func TestSecretRoundTrip(t *testing.T) {
+	d := &S3fsDriver{configKey: configKey("passphrase")}
+	for _, secret := range []string{"", "secret", "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", strings.Repeat("x", 1000)} {
+		encrypted, err := d.encryptSecret(secret)
+		if err != nil {
+			t.Fatalf("could not encrypt %q: %s", secret, err)
+		}
+		if !strings.HasPrefix(encrypted, encryptedPrefix) || (len(secret) > 0 && strings.Contains(encrypted, secret)) {
+			t.Errorf("secret %q not encrypted: %s", secret, encrypted)
+		}
+		again, _ := d.encryptSecret(secret)
+		if again == encrypted {
+			t.Errorf("secret %q encrypted twice with the same nonce", secret)
+		}
+		plain, legacy, err := d.decryptSecret(encrypted)
+		if err != nil || plain != secret || legacy {
+			t.Errorf("decryptSecret(encryptSecret(%q)) = %q, %v, %v", secret, plain, legacy, err)
+		}
+	}
+}
+
+func TestDecryptSecret(t *testing.T) {
+	legacy := &S3fsDriver{configKey: legacyConfigKey("driversecret")}
+	legacySecret, err := legacy.encryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &S3fsDriver{configKey: configKey("other")}
+	otherSecret, err := other.encryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		driver *S3fsDriver
+		secret string
+		plain  string
+		legacy bool
+		err    string
+	}{
+		{"unencrypted", &S3fsDriver{}, "secret", "secret", false, ""},
+		{"no key", &S3fsDriver{}, otherSecret, "", false, "no config key"},
+		{"wrong key", &S3fsDriver{configKey: configKey("passphrase")}, otherSecret, "", false, "could not decrypt"},
+		{"legacy key", &S3fsDriver{legacyConfigKey: legacyConfigKey("driversecret")}, legacySecret, "secret", true, ""},
+		{"legacy key with a config key", &S3fsDriver{configKey: configKey("passphrase"), legacyConfigKey: legacyConfigKey("driversecret")}, legacySecret, "secret", true, ""},
+		{"secret key changed", &S3fsDriver{configKey: configKey("passphrase"), legacyConfigKey: legacyConfigKey("newsecret")}, legacySecret, "", false, "secret key changed"},
+		{"corrupted", &S3fsDriver{configKey: configKey("other")}, otherSecret[:len(otherSecret)-4] + "AAAA", "", false, "could not decrypt"},
+		{"too short", &S3fsDriver{configKey: configKey("other")}, encryptedPrefix + "AAAA", "", false, "could not decrypt"},
+	}
+	for _, test := range tests {
+		plain, legacy, err := test.driver.decryptSecret(test.secret)
+		switch {
+		case len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: decryptSecret = %v, expected %q", test.name, err, test.err)
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%s: decryptSecret failed: %s", test.name, err)
+		case plain != test.plain || legacy != test.legacy:
+			t.Errorf("%s: decryptSecret = %q, %v, expected %q, %v", test.name, plain, legacy, test.plain, test.legacy)
+		}
+	}
+}
+
+func TestSplitCredentialsNeedsConfigKey(t *testing.T) {
+	d := &S3fsDriver{legacyConfigKey: legacyConfigKey("driversecret")}
+	_, _, err := d.splitCredentials(map[string]string{accessKeyOption: "key", secretKeyOption: "secret"})
+	if err != errNoConfigKey {
+		t.Errorf("secret stored without a config key: %v", err)
+	}
+}
+
+func TestVolumeClientSecret(t *testing.T) {
+	d := &S3fsDriver{Endpoint: "127.0.0.1:9000", Region: "us-east-1", configKey: configKey("passphrase"), clients: make(map[string]*minio.Client)}
+	clients := make([]*minio.Client, 0)
+	for _, secret := range []string{"secret", "other", "secret"} {
+		creds, _, err := d.splitCredentials(map[string]string{accessKeyOption: "key", secretKeyOption: secret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clt, err := d.volumeClient(&VolConfig{Name: "vol", Credentials: creds})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, clt)
+	}
+	if clients[0] == clients[1] {
+		t.Errorf("client of another secret reused for the same access key")
+	}
+	if clients[0] != clients[2] {
+		t.Errorf("client of the same credentials not reused")
+	}
+}
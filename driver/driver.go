@@ -3,23 +3,19 @@ package driver
 import (
 	"fmt"
 	"io/ioutil"
-	"net/url"
 	"os"
-	"os/exec"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v6/pkg/credentials"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
 const (
-	emptyVolume = `# s3vol configuration
-# volumename;bucket;options
-`
 	configObject = "volumes"
 	s3fspwdfile  = "/etc/passwd-s3fs"
 )
@@ -30,22 +26,60 @@ type S3fsDriver struct {
 	UseSSL             bool
 	AccessKey          string
 	SecretKey          string
+	SessionToken       string
+	CredentialsSource  string
 	Region             string
 	RootMount          string
+	StateFile          string
 	ReplaceUnderscores bool
 	ConfigBucketName   string
+	SnapshotBucket     string
+	Backend            string
+	Retention          time.Duration
+	MountTimeout       time.Duration
+	AllowedPaths       []string
+	PasswdDir          string
+	CredentialsFile    string
 	Defaults           map[string]string
 	s3client           *minio.Client
+	clients            map[string]*minio.Client
+	clientsLock        sync.Mutex
+	profiles           map[string]*Profile
+	profilesLock       sync.RWMutex
+	configKey          []byte
+	legacyConfigKey    []byte
+	creds              *credentials.Credentials
+	s3fsIAM            bool
 	s3fspath           string
-	mounts             map[string]int
+	mounts             map[string]*mountInfo
 	mountsLock         sync.Mutex
+	locker             Locker
+	usage              usageCache
 }
 
 //VolConfig represents the configuration of a volume
 type VolConfig struct {
-	Name    string
-	Bucket  string
-	Options map[string]string
+	Name        string            `json:"name"`
+	Bucket      string            `json:"bucket"`
+	Prefix      string            `json:"prefix,omitempty"`
+	Owned       bool              `json:"owned,omitempty"`
+	Purge       bool              `json:"purge,omitempty"`
+	Options     map[string]string `json:"options,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Endpoint    string            `json:"endpoint,omitempty"`
+	Region      string            `json:"region,omitempty"`
+	Profile     string            `json:"profile,omitempty"`
+	Credentials *VolCredentials   `json:"credentials,omitempty"`
+	CreatedBy   string            `json:"createdBy,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	RemovedAt   *time.Time        `json:"removedAt,omitempty"`
+	RemovePurge bool              `json:"removePurge,omitempty"`
+	Origin      string            `json:"origin,omitempty"`
+	Populating  bool              `json:"populating,omitempty"`
+	// PopulateOwner and PopulateUpdated tell who copies the data and when it was last alive
+	PopulateOwner   *LockOwner `json:"populateOwner,omitempty"`
+	PopulateUpdated *time.Time `json:"populateUpdated,omitempty"`
+	Backend         string     `json:"backend,omitempty"`
 }
 
 //NewDriver creates a new S3FS driver
@@ -74,101 +108,184 @@ func NewDriver(c *cli.Context) (*S3fsDriver, error) {
 			break
 		}
 	}
-	if len(s3fspath) == 0 {
+	if len(s3fspath) == 0 && c.String("backend") == backendS3fs {
 		log.WithField("command", "driver").Errorf("could not get s3fs path: provide s3fs path or install it")
 		return nil, fmt.Errorf("could not get s3fs path: provide s3fs path or install it")
 	}
-	u, err := url.Parse(c.String("endpoint"))
+	mount := c.String("mount")
+	mount = strings.TrimRight(mount, "/")
+	defaults, err := ParseOptions(c.String("defaults"))
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not parse options: %s", err)
+		return nil, fmt.Errorf("could not parse options: %s", err)
+	}
+	driver, err := NewAdminDriver(c)
+	if err != nil {
+		return nil, err
+	}
+	// the secrets stored without a config key are lost with the secret key
+	err = driver.rekeySecrets()
 	if err != nil {
-		log.WithField("command", "driver").Errorf("could not parse endpoint: %s", err)
-		return nil, fmt.Errorf("could not parse enpoint: %s", err)
+		return nil, err
+	}
+	// the copies interrupted by a crash never end
+	driver.failInterrupted()
+	// save s3fs password
+	if driver.CredentialsSource == credentialsStatic {
+		err = ioutil.WriteFile(s3fspwdfile, []byte(fmt.Sprintf("%s:%s", driver.AccessKey, driver.SecretKey)), 0600)
+		if err != nil {
+			log.WithField("command", "driver").Errorf("could not write s3fs password file: %s", err)
+			return nil, fmt.Errorf("could not write s3fs password file: %s", err)
+		}
+	}
+	// add connection info to default options
+	defaults["url"] = c.String("endpoint")
+	defaults["endpoint"] = driver.Region
+	// default use path request style for minio
+	defaults["use_path_request_style"] = "true"
+	driver.RootMount = mount
+	driver.Defaults = defaults
+	driver.s3fspath = s3fspath
+	driver.StateFile = c.String("statefile")
+	driver.PasswdDir = c.String("passwd-dir")
+	driver.MountTimeout = time.Duration(c.Int("mount-timeout")) * time.Second
+	log.WithField("command", "driver").Infof("mount: %s", mount)
+	log.WithField("command", "driver").Infof("default options: %s", OptionsToString(defaults))
+	log.WithField("command", "driver").Infof("state file: %s", driver.StateFile)
+	log.WithField("command", "driver").Infof("mount timeout: %s", driver.MountTimeout)
+	// get back the mounts of a previous run
+	err = driver.reconcileMounts()
+	if err != nil {
+		return nil, err
+	}
+	// s3fs doesn't refresh temporary credentials by itself
+	if driver.CredentialsSource == credentialsIAM && !driver.s3fsIAM {
+		go driver.refreshCredentials()
+	}
+	// the retention of the plugin applies to all the hosts and the command line
+	if c.IsSet("retention") {
+		err = driver.saveSettings()
+		if err != nil {
+			return nil, err
+		}
 	}
-	endpoint := u.Host
-	if u.Scheme != "https" && u.Scheme != "http" {
-		log.WithField("command", "driver").Errorf("s3 scheme not http(s)")
-		return nil, fmt.Errorf("s3 scheme not http(s)")
+	// purge the removed volumes after their retention
+	if driver.Retention > 0 {
+		go driver.reapTrash()
 	}
-	usessl := true
-	if u.Scheme == "http" {
-		usessl = false
+	// return the driver
+	return driver, nil
+}
+
+//NewAdminDriver creates a driver limited to the volumes configuration (no s3fs mounts)
+func NewAdminDriver(c *cli.Context) (*S3fsDriver, error) {
+	endpoint, usessl, err := parseEndpoint(c.String("endpoint"))
+	if err != nil {
+		log.WithField("command", "driver").Errorf("%s", err)
+		return nil, err
 	}
 	accesskey := c.String("accesskey")
 	secretkey := c.String("secretkey")
+	source := c.String("credentials")
+	if len(source) == 0 {
+		source = credentialsStatic
+	}
+	creds, err := driverCredentials(c)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not get credentials: %s", err)
+		return nil, fmt.Errorf("could not get credentials: %s", err)
+	}
 	region := c.String("region")
 	replaceunderscores := c.Bool("replaceunderscores")
 	configbucketname := c.String("configbucket")
-	mount := c.String("mount")
-	mount = strings.TrimRight(mount, "/")
-	defaults, err := parseOptions(c.String("defaults"))
+	err = checkBackend(c.String("backend"))
 	if err != nil {
-		log.WithField("command", "driver").Errorf("could not parse options: %s", err)
-		return nil, fmt.Errorf("could not parse options: %s", err)
+		log.WithField("command", "driver").Errorf("%s", err)
+		return nil, err
 	}
-	// save s3fs password
-	err = ioutil.WriteFile(s3fspwdfile, []byte(fmt.Sprintf("%s:%s", accesskey, secretkey)), 0660)
+	allowedpaths, err := parsePaths(c.String("allowed-paths"))
 	if err != nil {
-		log.WithField("command", "driver").Errorf("could not write s3fs password file: %s", err)
-		return nil, fmt.Errorf("could not write s3fs password file: %s", err)
+		log.WithField("command", "driver").Errorf("could not parse allowed paths: %s", err)
+		return nil, fmt.Errorf("could not parse allowed paths: %s", err)
 	}
-	// add connection info to default options
-	defaults["url"] = u.String()
-	defaults["endpoint"] = region
-	// default use path request style for minio
-	defaults["use_path_request_style"] = "true"
 	driver := &S3fsDriver{
 		Endpoint:           endpoint,
 		UseSSL:             usessl,
 		AccessKey:          accesskey,
 		SecretKey:          secretkey,
+		SessionToken:       c.String("sessiontoken"),
+		CredentialsSource:  source,
 		Region:             region,
-		RootMount:          mount,
 		ReplaceUnderscores: replaceunderscores,
 		ConfigBucketName:   configbucketname,
-		Defaults:           defaults,
-		s3fspath:           s3fspath,
-		mounts:             make(map[string]int),
+		SnapshotBucket:     c.String("snapshot-bucket"),
+		StateFile:          c.String("statefile"),
+		Backend:            c.String("backend"),
+		AllowedPaths:       allowedpaths,
+		Retention:          time.Duration(c.Int("retention")) * 24 * time.Hour,
+		Defaults:           make(map[string]string),
+		mounts:             make(map[string]*mountInfo),
+		clients:            make(map[string]*minio.Client),
+		configKey:          configKey(c.String("config-key")),
+		legacyConfigKey:    legacyConfigKey(secretkey),
+		CredentialsFile:    c.String("credentials-file"),
+		creds:              creds,
+		s3fsIAM:            s3fsIAM(c),
 	}
 	log.WithField("command", "driver").Infof("endpoint: %s", endpoint)
 	log.WithField("command", "driver").Infof("use ssl: %v", usessl)
+	log.WithField("command", "driver").Infof("credentials: %s", source)
+	if len(driver.configKey) == 0 {
+		log.WithField("command", "driver").Warnf("no config key to encrypt volume secrets: volumes with their own credentials are refused")
+	}
 	log.WithField("command", "driver").Infof("access key: %s", accesskey)
 	log.WithField("command", "driver").Infof("region: %s", region)
 	log.WithField("command", "driver").Infof("replace underscores: %v", replaceunderscores)
-	log.WithField("command", "driver").Infof("mount: %s", mount)
 	log.WithField("command", "driver").Infof("config bucket: %s", configbucketname)
-	log.WithField("command", "driver").Infof("default options: %s", optionsToString(defaults))
+	log.WithField("command", "driver").Infof("allowed paths: %s", strings.Join(allowedpaths, ","))
+	log.WithField("command", "driver").Infof("backend: %s", driver.Backend)
+	// named credentials
+	err = driver.ReloadProfiles()
+	if err != nil {
+		return nil, err
+	}
 	// get a s3 client
-	clt, err := minio.NewWithRegion(endpoint, accesskey, secretkey, usessl, region)
+	clt, err := minio.NewWithCredentials(endpoint, creds, usessl, region)
 	if err != nil {
 		log.WithField("command", "driver").Errorf("cannot get s3 client: %s", err)
 		return nil, fmt.Errorf("cannot get s3 client: %s", err)
 	}
+	// conditional headers for the locks
+	tr, err := minio.DefaultTransport(usessl)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("cannot get s3 transport: %s", err)
+		return nil, fmt.Errorf("cannot get s3 transport: %s", err)
+	}
+	clt.SetCustomTransport(&conditionalTransport{RoundTripper: tr})
 	driver.s3client = clt
-	err = driver.createBucket(configbucketname)
+	// get the lock backend
+	driver.locker, err = newLocker(c, clt, configbucketname)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("cannot get lock backend: %s", err)
+		return nil, fmt.Errorf("cannot get lock backend: %s", err)
+	}
+	log.WithField("command", "driver").Infof("lock backend: %s", c.String("lock-backend"))
+	_, err = driver.createBucket(clt, configbucketname, region)
 	if err != nil {
 		log.WithField("command", "driver").Errorf("could check bucket '%s': %s", configbucketname, err)
 		return nil, fmt.Errorf("could not check bucket '%s': %s", configbucketname, err)
 	}
-	// check config object existance
-	_, err = clt.StatObject(configbucketname, configObject, minio.StatObjectOptions{})
+	// migrate the config to one object per volume
+	err = driver.initConfig()
 	if err != nil {
-		// create an empty config object
-		reader := strings.NewReader(emptyVolume)
-		err := driver.Lock(configbucketname, configObject)
-		if err != nil {
-			log.WithField("command", "driver").Errorf("could not lock config in %s: %s", configbucketname, err)
-			return nil, fmt.Errorf("could not lock config in %s: %s", configbucketname, err)
-		}
-		_, err = clt.PutObject(configbucketname, configObject, reader, reader.Size(), minio.PutObjectOptions{})
-		if err != nil {
-			log.WithField("command", "driver").Errorf("could not create config in %s: %s", configbucketname, err)
-			return nil, fmt.Errorf("could not create config in %s: %s", configbucketname, err)
-		}
-		err = driver.UnLock(configbucketname, configObject)
-		if err != nil {
-			log.WithField("command", "driver").Errorf("could not unlock config in %s: %s", configbucketname, err)
-			return nil, fmt.Errorf("could not unlock config in %s: %s", configbucketname, err)
-		}
+		return nil, err
+	}
+	// the retention is shared through the config bucket
+	err = driver.loadSettings(c)
+	if err != nil {
+		return nil, err
 	}
+	log.WithField("command", "driver").Infof("retention: %d days", int(driver.Retention/(24*time.Hour)))
 	// return the driver
 	return driver, nil
 }
@@ -176,28 +293,202 @@ func NewDriver(c *cli.Context) (*S3fsDriver, error) {
 //Create creates a volume
 func (d *S3fsDriver) Create(req *volume.CreateRequest) error {
 	log.WithField("command", "driver").WithField("method", "create").Debugf("request: %+v", req)
+	// the volume name is part of its config object name and mount path
+	err := validateVolumeName(req.Name)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("%s", err)
+		return err
+	}
+	// a retried create reports a volume still being populated
+	err = d.checkPopulating(req.Name)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("%s", err)
+		return err
+	}
+	// options are passed to s3fs
+	options, labels := splitLabels(req.Options)
+	profile, options, err := d.splitProfile(options)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid profile for volume '%s': %s", req.Name, err)
+		return fmt.Errorf("invalid profile for volume '%s': %s", req.Name, err)
+	}
+	endpoint, region, options, err := splitEndpoint(options)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid endpoint for volume '%s': %s", req.Name, err)
+		return fmt.Errorf("invalid endpoint for volume '%s': %s", req.Name, err)
+	}
+	shared, prefix, options, err := splitBucket(options)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid bucket for volume '%s': %s", req.Name, err)
+		return fmt.Errorf("invalid bucket for volume '%s': %s", req.Name, err)
+	}
+	fromSnapshot, options, err := splitSnapshot(options)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid options for volume '%s': %s", req.Name, err)
+		return fmt.Errorf("invalid options for volume '%s': %s", req.Name, err)
+	}
+	clone, options, err := splitClone(options)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid options for volume '%s': %s", req.Name, err)
+		return fmt.Errorf("invalid options for volume '%s': %s", req.Name, err)
+	}
+	if len(fromSnapshot) > 0 && len(clone) > 0 {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid options for volume '%s': %s and %s are exclusive", req.Name, fromSnapshotOption, cloneOption)
+		return fmt.Errorf("invalid options for volume '%s': %s and %s are exclusive", req.Name, fromSnapshotOption, cloneOption)
+	}
+	external, purge, options, err := splitOwnership(options)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid options for volume '%s': %s", req.Name, err)
+		return fmt.Errorf("invalid options for volume '%s': %s", req.Name, err)
+	}
+	credentials, options, err := d.splitCredentials(options)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid credentials for volume '%s': %s", req.Name, err)
+		return fmt.Errorf("invalid credentials for volume '%s': %s", req.Name, err)
+	}
+	if len(profile) > 0 && credentials != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("volume '%s' can't have both a profile and credentials", req.Name)
+		return fmt.Errorf("volume '%s' can't have both a profile and credentials", req.Name)
+	}
+	backend, options, err := splitBackend(options)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid options for volume '%s': %s", req.Name, err)
+		return fmt.Errorf("invalid options for volume '%s': %s", req.Name, err)
+	}
+	// the volume keeps the backend it was created for
+	if len(backend) == 0 {
+		backend = d.Backend
+	}
+	err = d.validateOptions(backend, options)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid options for volume '%s': %s", req.Name, err)
+		return fmt.Errorf("invalid options for volume '%s': %s", req.Name, err)
+	}
 	// check bucket name
 	bucket := req.Name
 	if strings.Contains(bucket, "_") && d.ReplaceUnderscores {
 		bucket = strings.ReplaceAll(bucket, "_", "-")
 	}
-	// check that the bucket exists
-	err := d.createBucket(bucket)
+	if len(shared) > 0 {
+		bucket = shared
+	}
+	// the volumes never share the buckets of the driver
+	if bucket == d.ConfigBucketName || bucket == d.SnapshotBucket {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid bucket for volume '%s': '%s' is reserved for the driver", req.Name, bucket)
+		return fmt.Errorf("invalid bucket for volume '%s': '%s' is reserved for the driver", req.Name, bucket)
+	}
+	volConf := VolConfig{
+		Name:        req.Name,
+		Bucket:      bucket,
+		Prefix:      prefix,
+		Purge:       purge,
+		Options:     options,
+		Labels:      labels,
+		Endpoint:    endpoint,
+		Region:      region,
+		Profile:     profile,
+		Backend:     backend,
+		Credentials: credentials,
+		CreatedAt:   time.Now().UTC(),
+	}
+	err = d.checkEndpointAuth(&volConf)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("invalid credentials for volume '%s': %s", req.Name, err)
+		return fmt.Errorf("invalid credentials for volume '%s': %s", req.Name, err)
+	}
+	// the data of a removed volume is kept until its purge
+	trashed, err := d.trashedVolume(req.Name)
+	if err != nil {
+		return err
+	}
+	if trashed != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("volume '%s' is in the trash: restore it or wait for its purge", req.Name)
+		return fmt.Errorf("volume '%s' is in the trash: restore it or wait for its purge", req.Name)
+	}
+	var snap *Snapshot
+	if len(fromSnapshot) > 0 {
+		snap, err = d.snapshot(fromSnapshot)
+		if err != nil {
+			return err
+		}
+		err = d.checkSnapshotEndpoint(snap, &volConf)
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "create").Errorf("%s", err)
+			return err
+		}
+		volConf.Origin = "snapshot:" + snap.ID
+	}
+	var src *VolConfig
+	if len(clone) > 0 {
+		src, err = d.cloneSource(clone, &volConf)
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "create").Errorf("could not clone volume '%s': %s", clone, err)
+			return fmt.Errorf("could not clone volume '%s': %s", clone, err)
+		}
+	}
+	// an existing volume is created again with the same config, its bucket is left as is
+	existing, err := d.readVolumeConfig(volumeObjectName(req.Name))
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return d.sameVolume(existing, &volConf)
+	}
+	// check that the bucket exists with the volume credentials
+	clt, err := d.volumeClient(&volConf)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Errorf("could not get s3 client: %s", err)
+		return fmt.Errorf("could not get s3 client: %s", err)
+	}
+	// only the data created by the driver is removed with the volume
+	switch {
+	case external:
+		err = d.requireBucket(clt, bucket)
+	case len(prefix) > 0:
+		volConf.Owned, err = d.createPrefix(clt, &volConf)
+	default:
+		volConf.Owned, err = d.createBucket(clt, bucket, d.volumeRegion(&volConf))
+	}
 	if err != nil {
 		log.WithField("command", "driver").WithField("method", "create").Errorf("could check bucket '%s': %s", bucket, err)
 		return fmt.Errorf("could check bucket '%s': %s", bucket, err)
 	}
-	volConf := VolConfig{
-		Name:    req.Name,
-		Bucket:  bucket,
-		Options: req.Options,
+	// data copied once the volume is added
+	var fill func() error
+	switch {
+	case snap != nil:
+		fill = func() error { return d.copySnapshot(clt, snap, &volConf) }
+	case src != nil:
+		fill = func() error {
+			_, err := d.copyObjects(clt, src.Bucket, src.objectPrefix(), volConf.Bucket, volConf.objectPrefix())
+			return err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "create").Warnf("could not get hostname: %s", err)
+	}
+	volConf.CreatedBy = hostname
+	// the volume can't be used before its data is copied
+	if fill != nil {
+		volConf.PopulateOwner, err = getLockOwner()
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "create").Errorf("could not get populate owner: %s", err)
+			return fmt.Errorf("could not get populate owner: %s", err)
+		}
+		now := time.Now().UTC()
+		volConf.Populating = true
+		volConf.PopulateUpdated = &now
 	}
 	// add volume to config
-	err = d.addVolumeConfig(&volConf)
+	added, err := d.addVolumeConfig(&volConf)
 	if err != nil {
 		log.WithField("command", "driver").WithField("method", "create").Errorf("could add volume config: %s", err)
 		return fmt.Errorf("could add volume config: %s", err)
 	}
+	if added && fill != nil {
+		return d.populateVolume(&volConf, fill)
+	}
 	return nil
 }
 
@@ -210,26 +501,12 @@ func (d *S3fsDriver) List() (*volume.ListResponse, error) {
 		log.WithField("command", "driver").Errorf("could not get volumes config: %s", err)
 		return nil, fmt.Errorf("could not get volumes config: %s", err)
 	}
-	// get bucket infos
-	bucketInfos, err := d.s3client.ListBuckets()
-	if err != nil {
-		log.WithField("command", "driver").Errorf("could not get bucket infos: %s", err)
-		return nil, fmt.Errorf("could not get bucket infos: %s", err)
-	}
 	resp := make([]*volume.Volume, len(vols))
 	for i, v := range vols {
-		// search for the bucket creation date
-		creation := ""
-		for _, b := range bucketInfos {
-			if v.Bucket == b.Name {
-				creation = b.CreationDate.UTC().Format(time.RFC3339)
-				break
-			}
-		}
 		resp[i] = &volume.Volume{
 			Name:       v.Name,
 			Mountpoint: fmt.Sprintf("%s/%s", d.RootMount, v.Name),
-			CreatedAt:  creation,
+			CreatedAt:  v.createdAt(),
 		}
 	}
 	return &volume.ListResponse{Volumes: resp}, nil
@@ -243,25 +520,12 @@ func (d *S3fsDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
 		log.WithField("command", "driver").WithField("method", "get").Warnf("could not get volume config for '%s': %s", req.Name, err)
 		return nil, fmt.Errorf("could not get volume config for '%s': %s", req.Name, err)
 	}
-	// get bucket infos
-	bucketInfos, err := d.s3client.ListBuckets()
-	if err != nil {
-		log.WithField("command", "driver").WithField("method", "get").Errorf("could not get bucket infos: %s", err)
-		return nil, fmt.Errorf("could not get bucket infos: %s", err)
-	}
-	// get creation date
-	creation := ""
-	for _, b := range bucketInfos {
-		if vol.Bucket == b.Name {
-			creation = b.CreationDate.UTC().Format(time.RFC3339)
-			break
-		}
-	}
 	return &volume.GetResponse{
 		Volume: &volume.Volume{
 			Name:       vol.Name,
 			Mountpoint: fmt.Sprintf("%s/%s", d.RootMount, vol.Name),
-			CreatedAt:  creation,
+			CreatedAt:  vol.createdAt(),
+			Status:     d.volumeStatus(vol),
 		},
 	}, nil
 }
@@ -269,54 +533,78 @@ func (d *S3fsDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
 //Remove removes a volume
 func (d *S3fsDriver) Remove(req *volume.RemoveRequest) error {
 	log.WithField("command", "driver").WithField("method", "remove").Debugf("request: %+v", req)
+	return d.RemoveVolume(req.Name, false)
+}
+
+//RemoveVolume removes a volume, purge deletes the data of buckets not created by the driver
+func (d *S3fsDriver) RemoveVolume(name string, purge bool) error {
 	// get volume config
-	volConfig, err := d.getVolumeConfig(req.Name)
+	volConfig, err := d.getVolumeConfig(name)
 	if err != nil {
 		log.WithField("command", "driver").WithField("method", "remove").Errorf("could not get vol infos: %s", err)
 		return fmt.Errorf("could not get vol infos: %s", err)
 	}
-	// check bucket
-	buckets, err := d.s3client.ListBuckets()
-	if err != nil {
-		log.WithField("command", "driver").WithField("method", "remove").Errorf("could not list buckets: %s", err)
-		return fmt.Errorf("could not list buckets: %s", err)
-	}
-	for _, bucket := range buckets {
-		if bucket.Name == volConfig.Bucket {
-			log.WithField("command", "driver").WithField("method", "remove").Infof("removing bucket: %s", volConfig.Bucket)
-			// empty bucket
-			// channel of objects to remove
-			objectsCh := make(chan string)
-			// Send object names that are needed to be removed to objectsCh
-			go func() {
-				defer close(objectsCh)
-				// List all objects from a bucket
-				for object := range d.s3client.ListObjects(volConfig.Bucket, "", true, nil) {
-					if object.Err != nil {
-						log.WithField("command", "driver").WithField("method", "remove").Errorf("removing object from bucket '%s': %s", volConfig.Bucket, object.Err)
-						break
-					}
-					objectsCh <- object.Key
-				}
-			}()
-			// remove the obtained objects from channel
-			for rErr := range d.s3client.RemoveObjects(volConfig.Bucket, objectsCh) {
-				log.WithField("command", "driver").WithField("method", "remove").Errorf("error emptying bucket '%s': %s", volConfig.Bucket, rErr)
-				// don't exist: try to remove the bucket anyway
-				break
-			}
-			// remove bucket
-			err = d.s3client.RemoveBucket(volConfig.Bucket)
-			if err != nil {
-				log.WithField("command", "driver").WithField("method", "remove").Errorf("could not remove bucket: %s", err)
-				return fmt.Errorf("could not remove bucket: %s", err)
-			}
-			break
-		}
+	// the command line doesn't know the mounts and operations of the plugins
+	err = d.checkUnused(volConfig.Name)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "remove").Errorf("refusing to remove volume %s: %s", volConfig.Name, err)
+		return fmt.Errorf("refusing to remove volume %s: %s", volConfig.Name, err)
+	}
+	if !volConfig.ownsData(purge) {
+		log.WithField("command", "driver").WithField("method", "remove").Infof("keeping data of volume %s in %s: not created by the driver", volConfig.Name, volConfig.Source())
+		return d.removeVolume(volConfig)
+	}
+	// keep the data until the end of the retention
+	if d.Retention > 0 {
+		volConfig.RemovePurge = purge
+		return d.trashVolume(volConfig)
 	}
-	// remove config
+	err = d.deleteData(volConfig)
+	if err != nil {
+		return err
+	}
+	return d.removeVolume(volConfig)
+}
+
+// deleteData deletes the bucket of a volume or the objects of its prefix
+func (d *S3fsDriver) deleteData(volConfig *VolConfig) error {
+	// check bucket with the volume credentials
+	clt, err := d.volumeClient(volConfig)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "remove").Errorf("could not get s3 client: %s", err)
+		return fmt.Errorf("could not get s3 client: %s", err)
+	}
+	// never remove a shared bucket
+	if len(volConfig.Prefix) > 0 {
+		return d.removePrefix(clt, volConfig)
+	}
+	exists, err := clt.BucketExists(volConfig.Bucket)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "remove").Errorf("could not check bucket: %s", err)
+		return fmt.Errorf("could not check bucket: %s", err)
+	}
+	if !exists {
+		return nil
+	}
+	log.WithField("command", "driver").WithField("method", "remove").Infof("removing bucket: %s", volConfig.Bucket)
+	// a bucket can only be removed once empty
+	err = d.purge(clt, volConfig.Bucket, "")
+	if err != nil {
+		return fmt.Errorf("could not empty bucket: %s", err)
+	}
+	// remove bucket
+	err = clt.RemoveBucket(volConfig.Bucket)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "remove").Errorf("could not remove bucket: %s", err)
+		return fmt.Errorf("could not remove bucket: %s", err)
+	}
+	return nil
+}
+
+// removeVolume removes the config of a volume
+func (d *S3fsDriver) removeVolume(volConfig *VolConfig) error {
 	log.WithField("command", "driver").WithField("method", "remove").Infof("removing config: %s", volConfig.Name)
-	err = d.removeVolumeConfig(volConfig.Name)
+	err := d.removeVolumeConfig(volConfig.Name)
 	if err != nil {
 		log.WithField("command", "driver").WithField("method", "remove").Errorf("could not remove volume config: %s", err)
 		return fmt.Errorf("could not remove volume config: %s", err)
@@ -346,66 +634,173 @@ func (d *S3fsDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, err
 		log.WithField("command", "driver").WithField("method", "mount").Errorf("could not get vol infos: %s", err)
 		return nil, fmt.Errorf("could not get vol infos: %s", err)
 	}
+	// the configuration may predate the validation
+	err = validateVolumeName(volConfig.Name)
+	if err == nil {
+		err = d.validateOptions(d.volumeBackend(volConfig), volConfig.Options)
+	}
+	if err == nil {
+		err = volConfig.populated()
+	}
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "mount").Errorf("refusing to mount volume '%s': %s", volConfig.Name, err)
+		return nil, fmt.Errorf("refusing to mount volume '%s': %s", volConfig.Name, err)
+	}
 	// generate mount path
 	path := fmt.Sprintf("%s/%s", d.RootMount, volConfig.Name)
 	// check if already mounted
 	d.mountsLock.Lock()
+	for {
+		m, ok := d.mounts[volConfig.Name]
+		if !ok || len(m.IDs) == 0 {
+			break
+		}
+		if m.starting != nil {
+			// wait for the mount in progress
+			starting := m.starting
+			d.mountsLock.Unlock()
+			<-starting
+			d.mountsLock.Lock()
+			continue
+		}
+		defer d.mountsLock.Unlock()
+		// the backend is down until its supervisor remounts it
+		if !isMounted(path) {
+			log.WithField("command", "driver").WithField("method", "mount").Errorf("volume %s is not available: %s is being restarted", volConfig.Name, m.Backend)
+			return nil, fmt.Errorf("volume %s is not available: %s is being restarted", volConfig.Name, m.Backend)
+		}
+		// docker may repeat a mount request
+		if !m.addID(req.ID) {
+			log.WithField("command", "driver").WithField("method", "mount").Warnf("volume %s is already mounted for %s", volConfig.Name, req.ID)
+			return &volume.MountResponse{Mountpoint: path}, nil
+		}
+		d.saveMounts()
+		log.WithField("command", "driver").WithField("method", "mount").Infof("volume %s is used by %d containers", volConfig.Name, len(m.IDs))
+		return &volume.MountResponse{Mountpoint: path}, nil
+	}
+	// the other requests of the volume wait for this mount
+	pending := &mountInfo{
+		Volume:     volConfig.Name,
+		Mountpoint: path,
+		IDs:        []string{req.ID},
+		starting:   make(chan struct{}),
+		mounting:   true,
+	}
+	d.mounts[volConfig.Name] = pending
+	d.mountsLock.Unlock()
+	m, exited, err := d.startVolume(volConfig, path, req.ID)
+	if err == nil {
+		d.holdMount(volConfig.Name)
+	}
+	d.mountsLock.Lock()
 	defer d.mountsLock.Unlock()
-	if _, ok := d.mounts[volConfig.Name]; ok {
-		d.mounts[volConfig.Name] = 0
+	close(pending.starting)
+	if err != nil {
+		delete(d.mounts, volConfig.Name)
+		d.removePasswdFile(volConfig.Name)
+		return nil, err
 	}
-	if d.mounts[volConfig.Name] > 0 {
-		d.mounts[volConfig.Name]++
-		log.WithField("command", "driver").WithField("method", "mount").Infof("volume %s is used by %d containers", volConfig.Name, d.mounts[volConfig.Name])
-		return &volume.MountResponse{Mountpoint: path}, nil
+	d.mounts[volConfig.Name] = m
+	d.saveMounts()
+	if exited != nil {
+		go d.supervise(m, exited)
 	}
-	// merging driver options and volume options
-	// volume options have precedence
-	options := d.Defaults
-	for k, v := range volConfig.Options {
-		options[k] = v
+	log.WithField("command", "driver").WithField("method", "mount").Infof("volume %s is used by %d containers", volConfig.Name, len(m.IDs))
+	return &volume.MountResponse{Mountpoint: path}, nil
+}
+
+// startVolume mounts a volume and waits for it to be ready (without the mount lock)
+// it returns the channel receiving the exit of the backend process (nil for the native backend)
+func (d *S3fsDriver) startVolume(volConfig *VolConfig, path string, id string) (*mountInfo, <-chan error, error) {
+	spec, rotate, err := d.prepareMount(volConfig, path)
+	if err != nil {
+		return nil, nil, err
 	}
 	// create path if not exists
 	info, err := os.Stat(path)
 	if err != nil && !os.IsNotExist(err) {
 		log.WithField("command", "driver").WithField("method", "mount").Errorf("could not get mount path %s: %s", path, err)
-		return nil, fmt.Errorf("could not get mount path %s: %s", path, err)
+		return nil, nil, fmt.Errorf("could not get mount path %s: %s", path, err)
 	}
 	if os.IsNotExist(err) {
 		// create path
 		err := os.Mkdir(path, 0770)
 		if err != nil {
 			log.WithField("command", "driver").WithField("method", "mount").Errorf("could not create mount path %s: %s", path, err)
-			return nil, fmt.Errorf("could not create mount path %s: %s", path, err)
+			return nil, nil, fmt.Errorf("could not create mount path %s: %s", path, err)
 		}
 	} else {
 		if !info.IsDir() {
 			log.WithField("command", "driver").WithField("method", "mount").Errorf("mount path %s is not a directory: %s", path, err)
-			return nil, fmt.Errorf("mount path %s is not a directory: %s", path, err)
+			return nil, nil, fmt.Errorf("mount path %s is not a directory: %s", path, err)
 		}
 	}
-	// generate command
-	cmd := fmt.Sprintf("%s %s %s -o %s", d.s3fspath, volConfig.Bucket, path, optionsToString(options))
-	log.WithField("command", "driver").WithField("method", "mount").Infof("cmd: %s", cmd)
-	err = exec.Command("sh", "-c", cmd).Run()
-	if err != nil {
-		switch e := err.(type) {
-		case *exec.ExitError:
-			if len(e.Stderr) > 0 {
-				message := strings.ReplaceAll(string(e.Stderr), "\n", "\\n")
-				log.WithField("command", "driver").WithField("method", "mount").Errorf("error executing the mount command: '%s'", message)
-				return nil, fmt.Errorf("error executing the mount command: '%s'", message)
+	m := &mountInfo{
+		Volume:     volConfig.Name,
+		Mountpoint: path,
+		IDs:        []string{id},
+		PID:        os.Getpid(),
+		Started:    time.Now().UTC(),
+		Rotate:     rotate,
+		Backend:    spec.backend,
+	}
+	if spec.backend == backendNative {
+		// the native filesystem is served by the plugin
+		err = d.mountNative(volConfig, spec)
+		if err == nil {
+			err = d.waitReady(path, nil)
+			if err != nil && isMounted(path) {
+				lazyUnmount(path)
 			}
-			log.WithField("command", "driver").WithField("method", "mount").Errorf("error executing the mount command: %s", err)
-			return nil, fmt.Errorf("error executing the mount command: %s", err)
-		default:
-			log.WithField("command", "driver").WithField("method", "mount").Errorf("error executing the mount command: %s", err)
-			return nil, fmt.Errorf("error executing the mount command: %s", err)
 		}
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "mount").Errorf("could not mount volume %s: %s", volConfig.Name, err)
+			return nil, nil, fmt.Errorf("could not mount volume %s: %s", volConfig.Name, err)
+		}
+		return m, nil, nil
 	}
-	d.mounts[volConfig.Name]++
-	log.WithField("command", "driver").WithField("method", "mount").Infof("volume %s is used by %d containers", volConfig.Name, d.mounts[volConfig.Name])
-	return &volume.MountResponse{Mountpoint: path}, nil
+	m.output = newMountOutput(volConfig, spec.backend)
+	pid, exited, err := d.startMount(spec, m.output)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.PID = pid
+	return m, exited, nil
+}
+
+// prepareMount gets the mount of a volume and writes its credentials
+// it returns if the credentials are rotated with the driver ones
+func (d *S3fsDriver) prepareMount(volConfig *VolConfig, path string) (*mountSpec, bool, error) {
+	backend := d.volumeBackend(volConfig)
+	binary, err := d.backendPath(backend)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "mount").Errorf("could not mount volume %s: %s", volConfig.Name, err)
+		return nil, false, fmt.Errorf("could not mount volume %s: %s", volConfig.Name, err)
+	}
+	spec := &mountSpec{
+		backend:    backend,
+		binary:     binary,
+		bucket:     volConfig.Bucket,
+		prefix:     volConfig.Prefix,
+		mountpoint: path,
+		// merging driver options and volume options
+		options: d.mergeOptions(volConfig),
+	}
+	// volume credentials
+	var rotate bool
+	switch backend {
+	case backendS3fs:
+		spec.env, rotate, err = d.volumeConnection(volConfig, spec.options)
+	case backendNative:
+		// the filesystem uses the s3 client of the volume
+	default:
+		rotate, err = d.awsConnection(volConfig, spec)
+	}
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "mount").Errorf("could not write credentials of volume %s: %s", volConfig.Name, err)
+		return nil, false, fmt.Errorf("could not write credentials of volume %s: %s", volConfig.Name, err)
+	}
+	return spec, rotate, nil
 }
 
 //Unmount unmounts a volume
@@ -422,44 +817,42 @@ func (d *S3fsDriver) Unmount(req *volume.UnmountRequest) error {
 	d.mountsLock.Lock()
 	defer d.mountsLock.Unlock()
 	// check that volume was mounted at least once
-	if _, ok := d.mounts[volConfig.Name]; !ok {
+	m, ok := d.mounts[volConfig.Name]
+	if !ok {
 		log.WithField("command", "driver").WithField("method", "unmount").Errorf("could not find mount infos for %s", volConfig.Name)
 		return fmt.Errorf("could not find mount infos for %s", volConfig.Name)
 	}
-	if d.mounts[volConfig.Name] <= 0 {
-		log.WithField("command", "driver").WithField("method", "unmount").Errorf("volume %s is apparently not mouted", volConfig.Name)
-		return fmt.Errorf("volume %s is apparently not mouted", volConfig.Name)
+	if m.mounting {
+		log.WithField("command", "driver").WithField("method", "unmount").Errorf("volume %s is being mounted", volConfig.Name)
+		return fmt.Errorf("volume %s is being mounted", volConfig.Name)
+	}
+	// docker may repeat an unmount request
+	if !m.removeID(req.ID) {
+		log.WithField("command", "driver").WithField("method", "unmount").Warnf("volume %s is not mounted for %s", volConfig.Name, req.ID)
+		return nil
 	}
 	// check if other container still have this mounted
-	if d.mounts[volConfig.Name] > 1 {
-		d.mounts[volConfig.Name]--
-		log.WithField("command", "driver").WithField("method", "unmount").Infof("volume %s is used by %d containers", volConfig.Name, d.mounts[volConfig.Name])
+	if len(m.IDs) > 0 {
+		d.saveMounts()
+		log.WithField("command", "driver").WithField("method", "unmount").Infof("volume %s is used by %d containers", volConfig.Name, len(m.IDs))
 		return nil
 	}
 	// generate mount path
 	path := fmt.Sprintf("%s/%s", d.RootMount, volConfig.Name)
-	// unmount volume
-	// generate command
-	cmd := fmt.Sprintf("umount %s", path)
-	log.WithField("command", "driver").WithField("method", "unmount").Infof("cmd: %s", cmd)
-	err = exec.Command("sh", "-c", cmd).Run()
-	if err != nil {
-		switch e := err.(type) {
-		case *exec.ExitError:
-			if len(e.Stderr) > 0 {
-				message := strings.ReplaceAll(string(e.Stderr), "\n", "\\n")
-				log.WithField("command", "driver").WithField("method", "umount").Errorf("error executing the umount command: '%s'", message)
-				return fmt.Errorf("error executing the umount command: '%s'", message)
-			}
-			log.WithField("command", "driver").WithField("method", "umount").Errorf("error executing the umount command: %s", err)
-			return fmt.Errorf("error executing the umount command: %s", err)
-		default:
-			log.WithField("command", "driver").WithField("method", "umount").Errorf("error executing the umount command: %s", err)
-			return fmt.Errorf("error executing the umount command: %s", err)
+	// a supervised mount may be down while it is restarted
+	if isMounted(path) {
+		err = unmount(path)
+		if err != nil {
+			// the volume is still mounted for this id
+			m.addID(req.ID)
+			return err
 		}
 	}
-	d.mounts[volConfig.Name]--
-	log.WithField("command", "driver").WithField("method", "unmount").Infof("volume %s is used by %d containers", volConfig.Name, d.mounts[volConfig.Name])
+	delete(d.mounts, volConfig.Name)
+	d.saveMounts()
+	d.releaseMount(volConfig.Name)
+	d.removePasswdFile(volConfig.Name)
+	log.WithField("command", "driver").WithField("method", "unmount").Infof("volume %s is used by %d containers", volConfig.Name, 0)
 	return nil
 }
 
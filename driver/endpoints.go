@@ -0,0 +1,136 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v6/pkg/credentials"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	endpointOption = "endpoint"
+	regionOption   = "region"
+)
+
+// splitEndpoint separates the s3 endpoint and region from the volume options
+func splitEndpoint(options map[string]string) (string, string, map[string]string, error) {
+	endpoint := options[endpointOption]
+	region := options[regionOption]
+	if len(endpoint) > 0 {
+		if _, _, err := parseEndpoint(endpoint); err != nil {
+			return "", "", nil, err
+		}
+	}
+	opts := make(map[string]string)
+	for k, v := range options {
+		if k != endpointOption && k != regionOption {
+			opts[k] = v
+		}
+	}
+	return endpoint, region, opts, nil
+}
+
+// endpointURL gets the url of the driver endpoint
+func (d *S3fsDriver) endpointURL() string {
+	if d.UseSSL {
+		return "https://" + d.Endpoint
+	}
+	return "http://" + d.Endpoint
+}
+
+// isDriverEndpoint checks if an endpoint url is the driver endpoint
+func (d *S3fsDriver) isDriverEndpoint(endpoint string) bool {
+	host, usessl, err := parseEndpoint(endpoint)
+	return err == nil && strings.EqualFold(host, d.Endpoint) && usessl == d.UseSSL
+}
+
+// checkEndpointAuth checks that a volume on another endpoint has its own credentials
+// the driver credentials are never sent to an endpoint chosen by a volume
+func (d *S3fsDriver) checkEndpointAuth(volConfig *VolConfig) error {
+	if len(volConfig.Endpoint) == 0 || volConfig.Credentials != nil || len(volConfig.Profile) > 0 || d.isDriverEndpoint(volConfig.Endpoint) {
+		return nil
+	}
+	return fmt.Errorf("endpoint %s needs the %s and %s options or a profile", volConfig.Endpoint, accessKeyOption, secretKeyOption)
+}
+
+// volumeEndpoint gets the s3 endpoint of a volume (empty for the driver endpoint)
+func (d *S3fsDriver) volumeEndpoint(volConfig *VolConfig) string {
+	if len(volConfig.Endpoint) > 0 {
+		return volConfig.Endpoint
+	}
+	if len(volConfig.Profile) > 0 {
+		if p, err := d.profile(volConfig.Profile); err == nil {
+			return p.Endpoint
+		}
+	}
+	return ""
+}
+
+// volumeRegion gets the region of the bucket of a volume
+func (d *S3fsDriver) volumeRegion(volConfig *VolConfig) string {
+	if len(volConfig.Region) > 0 {
+		return volConfig.Region
+	}
+	if len(volConfig.Profile) > 0 {
+		if p, err := d.profile(volConfig.Profile); err == nil && len(p.Region) > 0 {
+			return p.Region
+		}
+	}
+	return d.Region
+}
+
+// secretHash identifies the secret of volume credentials without revealing it
+func (a *volumeAuth) secretHash() string {
+	sum := sha256.Sum256([]byte(a.secretKey + "\x00" + a.sessionToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// volumeClient gets the s3 client of a volume from the clients pool
+// (the driver client for volumes on the driver endpoint with the driver credentials)
+func (d *S3fsDriver) volumeClient(volConfig *VolConfig) (*minio.Client, error) {
+	if volConfig.Credentials == nil && len(volConfig.Profile) == 0 && len(volConfig.Endpoint) == 0 && len(volConfig.Region) == 0 {
+		return d.s3client, nil
+	}
+	auth, err := d.volumeAuth(volConfig)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not get credentials of volume %s: %s", volConfig.Name, err)
+		return nil, fmt.Errorf("could not get credentials of volume %s: %s", volConfig.Name, err)
+	}
+	endpoint, usessl, region := d.Endpoint, d.UseSSL, d.Region
+	if len(auth.endpoint) > 0 {
+		endpoint, usessl, err = parseEndpoint(auth.endpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(auth.region) > 0 {
+		region = auth.region
+	}
+	// one client per credentials and endpoint
+	key := fmt.Sprintf("%s@%s/%s", auth.key, endpoint, region)
+	if len(auth.key) > 0 {
+		// the same access key with another secret never gets this client
+		key += "#" + auth.secretHash()
+	}
+	d.clientsLock.Lock()
+	defer d.clientsLock.Unlock()
+	if clt, ok := d.clients[key]; ok {
+		return clt, nil
+	}
+	creds := d.creds
+	if len(auth.key) > 0 {
+		creds = credentials.NewStaticV4(auth.accessKey, auth.secretKey, auth.sessionToken)
+	}
+	clt, err := minio.NewWithCredentials(endpoint, creds, usessl, region)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("cannot get s3 client for volume %s: %s", volConfig.Name, err)
+		return nil, fmt.Errorf("cannot get s3 client for volume %s: %s", volConfig.Name, err)
+	}
+	log.WithField("command", "driver").Debugf("new s3 client for %s on %s (%s)", auth.key, endpoint, region)
+	d.clients[key] = clt
+	return clt, nil
+}
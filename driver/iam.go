@@ -0,0 +1,177 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v6/pkg/credentials"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	credentialsStatic  = "static"
+	credentialsIAM     = "iam"
+	credentialsRefresh = time.Minute
+)
+
+// driverCredentials gets the s3 credentials of the driver from the credentials flag
+func driverCredentials(c *cli.Context) (*credentials.Credentials, error) {
+	switch c.String("credentials") {
+	case "", credentialsStatic:
+		if len(c.String("accesskey")) == 0 || len(c.String("secretkey")) == 0 {
+			return nil, fmt.Errorf("static credentials need an access key and a secret key")
+		}
+		return credentials.NewStaticV4(c.String("accesskey"), c.String("secretkey"), c.String("sessiontoken")), nil
+	case credentialsIAM:
+		// the iam provider reads the web identity settings from the environment
+		if len(c.String("web-identity-token-file")) > 0 {
+			os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", c.String("web-identity-token-file"))
+		}
+		if len(c.String("role-arn")) > 0 {
+			os.Setenv("AWS_ROLE_ARN", c.String("role-arn"))
+		}
+		return credentials.NewIAM(c.String("iam-endpoint")), nil
+	default:
+		return nil, fmt.Errorf("unknown credentials '%s': use static or iam", c.String("credentials"))
+	}
+}
+
+// s3fsIAM checks if s3fs can get the iam credentials by itself (default ec2 or ecs metadata endpoints)
+func s3fsIAM(c *cli.Context) bool {
+	return c.String("credentials") == credentialsIAM &&
+		len(c.String("iam-endpoint")) == 0 &&
+		len(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")) == 0 &&
+		len(os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")) == 0
+}
+
+// credentialsHome gets the home directory given to s3fs for the aws credentials file of a volume
+func (d *S3fsDriver) credentialsHome(volumeName string) string {
+	return filepath.Join(d.PasswdDir, volumeName+".home")
+}
+
+// writeAWSCredentials writes the aws credentials file read by s3fs (with the session token) and the other backends
+func (d *S3fsDriver) writeAWSCredentials(volumeName string, auth *volumeAuth) (string, error) {
+	home := d.credentialsHome(volumeName)
+	err := os.MkdirAll(filepath.Join(home, ".aws"), 0700)
+	if err != nil {
+		return "", fmt.Errorf("could not create credentials directory: %s", err)
+	}
+	content := fmt.Sprintf("[default]\naws_access_key_id = %s\naws_secret_access_key = %s\n", auth.accessKey, auth.secretKey)
+	if len(auth.sessionToken) > 0 {
+		content += fmt.Sprintf("aws_session_token = %s\n", auth.sessionToken)
+	}
+	// write and rename so s3fs never reads a partial file
+	path := filepath.Join(home, ".aws", "credentials")
+	err = ioutil.WriteFile(path+".tmp", []byte(content), 0600)
+	if err != nil {
+		return "", fmt.Errorf("could not write credentials file: %s", err)
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return "", fmt.Errorf("could not write credentials file: %s", err)
+	}
+	return home, nil
+}
+
+// processCredentials is the output of an aws credential_process
+type processCredentials struct {
+	Version         int    `json:"Version"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken,omitempty"`
+	Expiration      string `json:"Expiration"`
+}
+
+// writeProcessCredentials writes an aws credentials file reading the credentials of a volume with a credential_process
+// the aws sdk runs the process again once the credentials expire: they expire after the next refresh
+func (d *S3fsDriver) writeProcessCredentials(volumeName string, auth *volumeAuth) (string, error) {
+	home := d.credentialsHome(volumeName)
+	err := os.MkdirAll(filepath.Join(home, ".aws"), 0700)
+	if err != nil {
+		return "", fmt.Errorf("could not create credentials directory: %s", err)
+	}
+	data, err := json.Marshal(&processCredentials{
+		Version:         1,
+		AccessKeyID:     auth.accessKey,
+		SecretAccessKey: auth.secretKey,
+		SessionToken:    auth.sessionToken,
+		Expiration:      time.Now().Add(2 * credentialsRefresh).UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not encode credentials: %s", err)
+	}
+	// write and rename so the process never reads a partial file
+	process := filepath.Join(home, ".aws", "credentials.json")
+	err = ioutil.WriteFile(process+".tmp", data, 0600)
+	if err == nil {
+		err = os.Rename(process+".tmp", process)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not write credentials file: %s", err)
+	}
+	content := fmt.Sprintf("[default]\ncredential_process = cat %s\n", process)
+	path := filepath.Join(home, ".aws", "credentials")
+	err = ioutil.WriteFile(path+".tmp", []byte(content), 0600)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not write credentials file: %s", err)
+	}
+	return home, nil
+}
+
+// refreshCredentials rotates the credentials of the mounts using the driver temporary credentials
+func (d *S3fsDriver) refreshCredentials() {
+	// the mounts are started with the current credentials
+	last := ""
+	if v, err := d.creds.Get(); err == nil {
+		last = v.AccessKeyID + v.SessionToken
+	}
+	ticker := time.NewTicker(credentialsRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		// the provider gets new credentials when they are about to expire
+		v, err := d.creds.Get()
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "credentials").Errorf("could not refresh credentials: %s", err)
+			continue
+		}
+		if v.AccessKeyID+v.SessionToken != last {
+			log.WithField("command", "driver").WithField("method", "credentials").Infof("driver credentials renewed")
+			last = v.AccessKeyID + v.SessionToken
+		}
+		// the process credentials are valid until the next refresh
+		d.rotateCredentials(v)
+	}
+}
+
+// rotateCredentials rewrites the credentials files of the mounts using the driver credentials
+// the mounts are never restarted: the aws sdk backends read the credentials again when they expire
+// and s3fs reads them when it is started again
+func (d *S3fsDriver) rotateCredentials(v credentials.Value) {
+	auth := &volumeAuth{accessKey: v.AccessKeyID, secretKey: v.SecretAccessKey, sessionToken: v.SessionToken}
+	d.mountsLock.Lock()
+	defer d.mountsLock.Unlock()
+	for name, m := range d.mounts {
+		if !m.Rotate || m.mounting {
+			continue
+		}
+		var err error
+		if m.Backend == backendS3fs {
+			_, err = d.writeAWSCredentials(name, auth)
+		} else {
+			_, err = d.writeProcessCredentials(name, auth)
+		}
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "credentials").Errorf("could not rotate credentials of volume %s: %s", name, err)
+			continue
+		}
+		log.WithField("command", "driver").WithField("method", "credentials").Debugf("rotated credentials of volume %s", name)
+	}
+}
@@ -0,0 +1,227 @@
+package driver
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v6/pkg/credentials"
+	"github.com/urfave/cli/v2"
+)
+
+// iamStub is a metadata and sts endpoint handing out numbered temporary credentials
+type iamStub struct {
+	sync.Mutex
+	role   string
+	issued int
+	tokens []string
+}
+
+// next gets the next credentials
+func (s *iamStub) next() (string, string, string) {
+	s.Lock()
+	defer s.Unlock()
+	s.issued++
+	return fmt.Sprintf("ASIA%d", s.issued), fmt.Sprintf("secret%d", s.issued), fmt.Sprintf("token%d", s.issued)
+}
+
+func (s *iamStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// expired credentials are retrieved again on each use
+	expiration := time.Now().UTC().Format(time.RFC3339)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+		fmt.Fprintln(w, s.role)
+	case r.Method == http.MethodGet && r.URL.Path == "/latest/meta-data/iam/security-credentials/"+s.role:
+		key, secret, token := s.next()
+		fmt.Fprintf(w, `{"Code":"Success","Type":"AWS-HMAC","AccessKeyId":"%s","SecretAccessKey":"%s","Token":"%s","Expiration":"%s"}`, key, secret, token, expiration)
+	case r.Method == http.MethodPost && r.URL.Query().Get("Action") == "AssumeRoleWithWebIdentity":
+		s.Lock()
+		s.tokens = append(s.tokens, r.URL.Query().Get("WebIdentityToken"))
+		s.Unlock()
+		key, secret, token := s.next()
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleWithWebIdentityResult><Credentials><AccessKeyId>%s</AccessKeyId><SecretAccessKey>%s</SecretAccessKey><SessionToken>%s</SessionToken><Expiration>%s</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`, key, secret, token, expiration)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// setEnv sets an environment variable for a test
+func setEnv(t *testing.T, key string, value string) {
+	saved, ok := os.LookupEnv(key)
+	if len(value) > 0 {
+		os.Setenv(key, value)
+	} else {
+		os.Unsetenv(key)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, saved)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// iamContext gets the flags of the iam credentials
+func iamContext(endpoint string, tokenFile string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("credentials", credentialsIAM, "")
+	set.String("iam-endpoint", endpoint, "")
+	set.String("web-identity-token-file", tokenFile, "")
+	set.String("role-arn", "", "")
+	return cli.NewContext(nil, set, nil)
+}
+
+// cleanIAMEnv removes the iam settings of the environment for a test
+func cleanIAMEnv(t *testing.T) {
+	for _, key := range []string{"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI"} {
+		setEnv(t, key, "")
+	}
+}
+
+func TestIAMMetadataCredentials(t *testing.T) {
+	cleanIAMEnv(t)
+	stub := &iamStub{role: "s3vol"}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	c := iamContext(srv.URL, "")
+	if s3fsIAM(c) {
+		t.Errorf("s3fs can't get the credentials of another metadata endpoint")
+	}
+	creds, err := driverCredentials(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		v, err := creds.Get()
+		if err != nil {
+			t.Fatalf("could not get credentials: %s", err)
+		}
+		if v.AccessKeyID != fmt.Sprintf("ASIA%d", i) || v.SecretAccessKey != fmt.Sprintf("secret%d", i) || v.SessionToken != fmt.Sprintf("token%d", i) {
+			t.Errorf("unexpected credentials %+v", v)
+		}
+	}
+}
+
+func TestIAMWebIdentityCredentials(t *testing.T) {
+	cleanIAMEnv(t)
+	stub := &iamStub{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "s3vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	err = ioutil.WriteFile(tokenFile, []byte("jwt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := driverCredentials(iamContext(srv.URL, tokenFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatalf("could not get credentials: %s", err)
+	}
+	if v.AccessKeyID != "ASIA1" || v.SecretAccessKey != "secret1" || v.SessionToken != "token1" {
+		t.Errorf("unexpected credentials %+v", v)
+	}
+	if len(stub.tokens) != 1 || stub.tokens[0] != "jwt" {
+		t.Errorf("web identity token not sent: %v", stub.tokens)
+	}
+}
+
+func TestRotateCredentials(t *testing.T) {
+	cleanIAMEnv(t)
+	stub := &iamStub{role: "s3vol"}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "s3vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &S3fsDriver{
+		CredentialsSource: credentialsIAM,
+		PasswdDir:         dir,
+		creds:             credentials.NewIAM(srv.URL),
+		mounts:            make(map[string]*mountInfo),
+	}
+	// backend processes of mounts rotated with the driver credentials and of a mount with its own
+	mounts := map[string]string{"s3fs": backendS3fs, "goofys": backendGoofys, "own": backendGoofys}
+	exited := make(map[string]chan error)
+	for name, backend := range mounts {
+		cmd := exec.Command("sleep", "60")
+		err = cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Process.Kill()
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		exited[name] = done
+		d.mounts[name] = &mountInfo{Volume: name, IDs: []string{"1"}, PID: cmd.Process.Pid, Rotate: name != "own", Backend: backend}
+	}
+	v, err := d.creds.Get()
+	if err != nil {
+		t.Fatalf("could not get credentials: %s", err)
+	}
+	d.rotateCredentials(v)
+	// s3fs reads the credentials file when it starts again
+	data, err := ioutil.ReadFile(filepath.Join(d.credentialsHome("s3fs"), ".aws", "credentials"))
+	if err != nil {
+		t.Fatalf("credentials not written: %s", err)
+	}
+	if !strings.Contains(string(data), "aws_access_key_id = ASIA1\n") || !strings.Contains(string(data), "aws_session_token = token1\n") {
+		t.Errorf("unexpected credentials file %s", data)
+	}
+	// the aws sdk runs the credential process again when the credentials expire
+	process := filepath.Join(d.credentialsHome("goofys"), ".aws", "credentials.json")
+	data, err = ioutil.ReadFile(filepath.Join(d.credentialsHome("goofys"), ".aws", "credentials"))
+	if err != nil {
+		t.Fatalf("credentials not written: %s", err)
+	}
+	if string(data) != "[default]\ncredential_process = cat "+process+"\n" {
+		t.Errorf("unexpected credentials file %s", data)
+	}
+	data, err = exec.Command("sh", "-c", "cat "+process).Output()
+	if err != nil {
+		t.Fatalf("could not run the credential process: %s", err)
+	}
+	creds := &processCredentials{}
+	err = json.Unmarshal(data, creds)
+	if err != nil {
+		t.Fatalf("could not decode process credentials %s: %s", data, err)
+	}
+	if creds.Version != 1 || creds.AccessKeyID != "ASIA1" || creds.SecretAccessKey != "secret1" || creds.SessionToken != "token1" {
+		t.Errorf("unexpected process credentials %s", data)
+	}
+	expiration, err := time.Parse(time.RFC3339, creds.Expiration)
+	if err != nil || !expiration.After(time.Now().Add(credentialsRefresh)) {
+		t.Errorf("process credentials expire before the next refresh: %s", creds.Expiration)
+	}
+	if _, err := os.Stat(d.credentialsHome("own")); !os.IsNotExist(err) {
+		t.Errorf("credentials written for a mount with its own credentials")
+	}
+	// the mounts in use survive the renewal
+	for name := range mounts {
+		select {
+		case <-exited[name]:
+			t.Errorf("backend of mount %s in use stopped by a renewal", name)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -2,110 +2,211 @@ package driver
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/minio/minio-go/v6"
-	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
 )
 
 const (
-	lockExt     = ".ext.lock"
-	lockWait    = 50 * time.Millisecond
-	lockTimeOut = 100
+	lockExt  = ".ext.lock"
+	lockWait = 50 * time.Millisecond
+	lockTTL  = 30 * time.Second
+	// lockTimeOut outlasts the lease of a lock left by a stopped holder
+	lockTimeOut = lockTTL + 5*time.Second
+	// lockRequestTimeOut is the timeout of a request to a lock backend
+	lockRequestTimeOut = 5 * time.Second
 )
 
-// Lock locks an object
-func (d *S3fsDriver) Lock(bucket string, object string) error {
-	log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", bucket).WithField("object", object).Debugf("locking object")
-	lock := fmt.Sprintf("%s%s", object, lockExt)
-	hostname, err := os.Hostname()
-	if err != nil {
-		log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", bucket).WithField("object", object).Errorf("could not get hostname: %s", err)
-		return fmt.Errorf("could not get hostname: %s", err)
-	}
-	// loop while stat works - assume no stat means no file
-	count := 0
-	for {
-		_, err = d.s3client.StatObject(bucket, lock, minio.StatObjectOptions{})
-		if err != nil {
-			log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", bucket).WithField("object", lock).Debugf("could not stat lock: %s", err)
-			break
+// lockRenew is the interval of the lease renewals of the held locks
+var lockRenew = lockTTL / 3
+
+// errNotFound is returned by json requests on missing resources
+var errNotFound = fmt.Errorf("not found")
+
+var (
+	processStart = time.Now().UTC()
+	processOwner *LockOwner
+	ownerOnce    sync.Once
+	ownerErr     error
+)
+
+//Locker locks named resources for all the hosts sharing the config bucket
+type Locker interface {
+	// Lock waits for and acquires the lock of a resource
+	Lock(name string) error
+	// UnLock releases the lock of a resource held by this process
+	// it fails if the lock was lost while held
+	UnLock(name string) error
+	// Held checks that a lock of this process is still held (its lease renewed)
+	Held(name string) error
+	// Locks gets the provided locks (all locks if none provided)
+	Locks(names ...string) ([]*LockInfo, error)
+	// Break forcibly removes a lock
+	Break(name string) (*LockInfo, error)
+}
+
+//LockOwner identifies the process holding a lock
+type LockOwner struct {
+	Hostname string    `json:"hostname"`
+	PID      int       `json:"pid"`
+	Started  time.Time `json:"started"`
+	Nonce    string    `json:"nonce"`
+}
+
+//LockInfo describes a lock
+type LockInfo struct {
+	Object  string    `json:"object"`
+	Owner   LockOwner `json:"owner"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	etag    string
+}
+
+// newLocker gets the lock backend selected by the lock-backend flag
+func newLocker(c *cli.Context, clt *minio.Client, bucket string) (Locker, error) {
+	endpoints := make([]string, 0)
+	for _, e := range strings.Split(c.String("lock-endpoints"), ",") {
+		if len(e) > 0 {
+			endpoints = append(endpoints, strings.TrimRight(e, "/"))
 		}
-		// lock does exist
-		obj, err := d.s3client.GetObject(bucket, lock, minio.GetObjectOptions{})
+	}
+	switch c.String("lock-backend") {
+	case "", "s3":
+		return newS3Locker(clt, bucket, c.Bool("lock-unconditional")), nil
+	case "file":
+		return newFileLocker(c.String("lock-dir"))
+	case "etcd":
+		return newEtcdLocker(endpoints, fmt.Sprintf("%s/%s/", strings.TrimRight(c.String("lock-prefix"), "/"), bucket))
+	default:
+		return nil, fmt.Errorf("unknown lock backend '%s': use s3, file or etcd", c.String("lock-backend"))
+	}
+}
+
+// lockName gets the name of the lock of a resource
+func lockName(name string) string {
+	return fmt.Sprintf("%s%s", strings.TrimSuffix(name, lockExt), lockExt)
+}
+
+// getLockOwner gets the identity of this process
+func getLockOwner() (*LockOwner, error) {
+	ownerOnce.Do(func() {
+		hostname, err := os.Hostname()
 		if err != nil {
-			log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", bucket).WithField("object", lock).Errorf("could not get lock: %s", err)
-			return fmt.Errorf("could not get lock: %s", err)
+			ownerErr = fmt.Errorf("could not get hostname: %s", err)
+			return
 		}
-		// read the object
-		buf := bytes.Buffer{}
-		_, err = buf.ReadFrom(obj)
+		nonce, err := newToken()
 		if err != nil {
-			log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", bucket).WithField("object", lock).Errorf("could not read lock: %s", err)
-			return fmt.Errorf("could not read lock: %s", err)
-		}
-		log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", bucket).WithField("object", lock).Debugf("lock is held by %s, waiting 50ms", buf.String())
-		// increase tried count
-		count++
-		if count > lockTimeOut {
-			log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", bucket).WithField("object", lock).Errorf("lock didn't disapear for 5s")
-			return fmt.Errorf("lock didn't disapear for 5s")
+			ownerErr = fmt.Errorf("could not generate nonce: %s", err)
+			return
 		}
-		time.Sleep(lockWait)
+		processOwner = &LockOwner{Hostname: hostname, PID: os.Getpid(), Started: processStart, Nonce: nonce}
+	})
+	return processOwner, ownerErr
+}
+
+// same checks if two owners are the same process
+func (o *LockOwner) same(other *LockOwner) bool {
+	return o.Hostname == other.Hostname && o.PID == other.PID && o.Started.Equal(other.Started) && o.Nonce == other.Nonce
+}
+
+// String describes a lock owner
+func (o *LockOwner) String() string {
+	if o == nil {
+		return "an unknown host"
 	}
-	reader := strings.NewReader(hostname)
-	_, err = d.s3client.PutObject(bucket, lock, reader, reader.Size(), minio.PutObjectOptions{})
-	if err != nil {
-		log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", bucket).WithField("object", object).Errorf("could not put lock: %s", err)
-		return fmt.Errorf("could not put lock: %s", err)
+	if o.PID == 0 {
+		return o.Hostname
 	}
-	// obtained the lock
-	log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", bucket).WithField("object", object).Infof("locked")
-	return nil
+	return fmt.Sprintf("%s[%d] started %s", o.Hostname, o.PID, o.Started.UTC().Format(time.RFC3339))
 }
 
-// UnLock unlocks an object
-func (d *S3fsDriver) UnLock(bucket string, object string) error {
-	log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", bucket).WithField("object", object).Debugf("unlocking object")
-	lock := fmt.Sprintf("%s%s", object, lockExt)
-	hostname, err := os.Hostname()
-	if err != nil {
-		log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", bucket).WithField("object", object).Errorf("could not get hostname: %s", err)
-		return fmt.Errorf("could not get hostname: %s", err)
-	}
-	// check existance of the lock
-	_, err = d.s3client.StatObject(bucket, lock, minio.StatObjectOptions{})
+// owns checks if a lock is the one acquired
+func (l *LockInfo) owns(other *LockInfo) bool {
+	return other != nil && l.Owner.same(&other.Owner) && l.Token == other.Token
+}
+
+// newToken generates a random token
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
 	if err != nil {
-		log.WithField("object", "minio").WithField("mehtod", "ulock").WithField("bucket", bucket).WithField("object", object).Warnf("could not stat lock: %s", err)
-		return nil
+		return "", err
 	}
-	// lock does exist
-	obj, err := d.s3client.GetObject(bucket, lock, minio.GetObjectOptions{})
-	if err != nil {
-		log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", bucket).WithField("object", lock).Errorf("could not get lock: %s", err)
-		return fmt.Errorf("could not get lock: %s", err)
+	return hex.EncodeToString(b), nil
+}
+
+// String describes the holder of a lock
+func (l *LockInfo) String() string {
+	if l.Expires.IsZero() {
+		return l.Owner.String()
 	}
-	// read the object
-	buf := bytes.Buffer{}
-	_, err = buf.ReadFrom(obj)
-	if err != nil {
-		log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", bucket).WithField("object", lock).Errorf("could not read lock: %s", err)
-		return fmt.Errorf("could not read lock: %s", err)
+	return fmt.Sprintf("%s until %s", l.Owner.String(), l.Expires.UTC().Format(time.RFC3339))
+}
+
+// expired checks if the lease of a lock is over
+func (l *LockInfo) expired() bool {
+	return time.Now().After(l.Expires)
+}
+
+// doJSON sends a json request to the first responding endpoint and decodes the response
+func doJSON(client *http.Client, endpoints []string, method string, path string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
 	}
-	if hostname != buf.String() {
-		log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", bucket).WithField("object", lock).Errorf("lock not generated by this server")
-		return fmt.Errorf("could not generated by this server")
+	var lastErr error
+	for _, endpoint := range endpoints {
+		req, err := http.NewRequest(method, endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			// try the next endpoint
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return errNotFound
+		}
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
 	}
-	// remove the lock
-	err = d.s3client.RemoveObject(bucket, lock)
-	if err != nil {
-		log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", bucket).WithField("object", lock).Errorf("could not remove lock: %s", err)
-		return fmt.Errorf("could not remove lock: %s", err)
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no endpoint provided")
 	}
-	// unlocked
-	log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", bucket).WithField("object", object).Infof("unlocked")
-	return nil
+	return lastErr
+}
+
+//Locks gets the locks of the provided objects of the config bucket (all locks if none provided)
+func (d *S3fsDriver) Locks(objects ...string) ([]*LockInfo, error) {
+	return d.locker.Locks(objects...)
+}
+
+//BreakLock forcibly removes the lock of an object of the config bucket
+func (d *S3fsDriver) BreakLock(object string) (*LockInfo, error) {
+	return d.locker.Break(object)
 }
@@ -0,0 +1,338 @@
+package driver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// etcdLocker locks resources with keys attached to leases in etcd (v3 json gateway)
+type etcdLocker struct {
+	endpoints []string
+	prefix    string
+	client    *http.Client
+	locks     map[string]*etcdLock
+	locksLock sync.Mutex
+}
+
+// etcdLock is an etcd lock held by this process
+type etcdLock struct {
+	lease string
+	info  *LockInfo
+	// err tells why the lease could not be kept alive
+	err  error
+	stop chan struct{}
+	done chan struct{}
+}
+
+// etcdKeyValue is a key value pair in etcd responses
+type etcdKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Lease string `json:"lease"`
+}
+
+// etcdRangeResponse is the response to a range request
+type etcdRangeResponse struct {
+	Kvs []*etcdKeyValue `json:"kvs"`
+}
+
+// etcdLeaseResponse is the response to lease requests
+type etcdLeaseResponse struct {
+	ID  string `json:"ID"`
+	TTL string `json:"TTL"`
+}
+
+// etcdKeepAliveResponse is the response to a keep alive request (streamed by the gateway)
+type etcdKeepAliveResponse struct {
+	Result *etcdLeaseResponse `json:"result"`
+}
+
+// etcdTxnResponse is the response to a transaction
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+	Responses []struct {
+		ResponseRange *etcdRangeResponse `json:"response_range"`
+	} `json:"responses"`
+}
+
+// newEtcdLocker creates an etcd locker
+func newEtcdLocker(endpoints []string, prefix string) (*etcdLocker, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoint provided")
+	}
+	return &etcdLocker{
+		endpoints: endpoints,
+		prefix:    prefix,
+		client:    &http.Client{Timeout: lockRequestTimeOut},
+		locks:     make(map[string]*etcdLock),
+	}, nil
+}
+
+// b64 encodes keys and values for the json gateway
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// prefixEnd gets the end of the range of keys with a prefix
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
+
+// decodeLock decodes the lock info of a key value pair
+func (l *etcdLocker) decodeLock(kv *etcdKeyValue) (*LockInfo, error) {
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	info := &LockInfo{}
+	err = json.Unmarshal(value, info)
+	if err != nil {
+		return nil, err
+	}
+	// the lease tells when the lock expires
+	if len(kv.Lease) > 0 && kv.Lease != "0" {
+		resp := &etcdLeaseResponse{}
+		err = doJSON(l.client, l.endpoints, http.MethodPost, "/v3/lease/timetolive", map[string]string{"ID": kv.Lease}, resp)
+		if err == nil {
+			ttl, _ := strconv.Atoi(resp.TTL)
+			info.Expires = time.Now().Add(time.Duration(ttl) * time.Second).UTC()
+		}
+	}
+	return info, nil
+}
+
+// keepAlive keeps the lease of a held lock alive until stopped or lost
+func (l *etcdLocker) keepAlive(name string, held *etcdLock) {
+	defer close(held.done)
+	ticker := time.NewTicker(lockRenew)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-held.stop:
+			return
+		case <-ticker.C:
+		}
+		resp := &etcdKeepAliveResponse{}
+		err := doJSON(l.client, l.endpoints, http.MethodPost, "/v3/lease/keepalive", map[string]string{"ID": held.lease}, resp)
+		if err == nil && (resp.Result == nil || len(resp.Result.TTL) == 0 || resp.Result.TTL == "0") {
+			// an expired lease is kept alive with no time to live
+			err = fmt.Errorf("lease %s expired", held.lease)
+		}
+		if err == nil {
+			// a broken lock loses its key but not its lease
+			err = l.checkKey(name, held)
+		}
+		if err != nil {
+			log.WithField("object", "etcd").WithField("mehtod", "lock").WithField("object", name).Errorf("could not renew lock: %s", err)
+			// the holder learns it from Held and UnLock
+			l.locksLock.Lock()
+			held.err = err
+			l.locksLock.Unlock()
+			return
+		}
+		log.WithField("object", "etcd").WithField("mehtod", "lock").WithField("object", name).Debugf("renewed lock lease %s", held.lease)
+	}
+}
+
+// checkKey checks that the key of a held lock is still the one of this process
+func (l *etcdLocker) checkKey(name string, held *etcdLock) error {
+	resp := &etcdRangeResponse{}
+	err := doJSON(l.client, l.endpoints, http.MethodPost, "/v3/kv/range", map[string]string{"key": b64(l.prefix + lockName(name))}, resp)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return fmt.Errorf("lock key removed")
+	}
+	if resp.Kvs[0].Lease != held.lease {
+		current := "unknown"
+		if info, err := l.decodeLock(resp.Kvs[0]); err == nil {
+			current = info.String()
+		}
+		return fmt.Errorf("lock taken by %s", current)
+	}
+	return nil
+}
+
+// Lock locks a resource
+func (l *etcdLocker) Lock(name string) error {
+	log.WithField("object", "etcd").WithField("mehtod", "lock").WithField("object", name).Debugf("locking object")
+	key := l.prefix + lockName(name)
+	owner, err := getLockOwner()
+	if err != nil {
+		log.WithField("object", "etcd").WithField("mehtod", "lock").WithField("object", name).Errorf("could not get lock owner: %s", err)
+		return fmt.Errorf("could not get lock owner: %s", err)
+	}
+	token, err := newToken()
+	if err != nil {
+		log.WithField("object", "etcd").WithField("mehtod", "lock").WithField("object", name).Errorf("could not generate lock token: %s", err)
+		return fmt.Errorf("could not generate lock token: %s", err)
+	}
+	// the key disapears with the lease
+	lease := &etcdLeaseResponse{}
+	err = doJSON(l.client, l.endpoints, http.MethodPost, "/v3/lease/grant", map[string]string{"TTL": strconv.Itoa(int(lockTTL.Seconds()))}, lease)
+	if err != nil {
+		log.WithField("object", "etcd").WithField("mehtod", "lock").WithField("object", name).Errorf("could not grant lease: %s", err)
+		return fmt.Errorf("could not grant lease: %s", err)
+	}
+	info := &LockInfo{Object: lockName(name), Owner: *owner, Token: token, Expires: time.Now().Add(lockTTL).UTC()}
+	value, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	// create the key if it doesn't exist, get it otherwise
+	txn := map[string]interface{}{
+		"compare": []map[string]string{{"key": b64(key), "target": "CREATE", "result": "EQUAL", "create_revision": "0"}},
+		"success": []map[string]interface{}{{"request_put": map[string]string{"key": b64(key), "value": b64(string(value)), "lease": lease.ID}}},
+		"failure": []map[string]interface{}{{"request_range": map[string]string{"key": b64(key)}}},
+	}
+	deadline := time.Now().Add(lockTimeOut)
+	for {
+		resp := &etcdTxnResponse{}
+		err = doJSON(l.client, l.endpoints, http.MethodPost, "/v3/kv/txn", txn, resp)
+		if err != nil {
+			break
+		}
+		if resp.Succeeded {
+			held := &etcdLock{lease: lease.ID, info: info, stop: make(chan struct{}), done: make(chan struct{})}
+			l.locksLock.Lock()
+			l.locks[key] = held
+			l.locksLock.Unlock()
+			go l.keepAlive(name, held)
+			log.WithField("object", "etcd").WithField("mehtod", "lock").WithField("object", name).Infof("locked")
+			return nil
+		}
+		holder := "unknown"
+		if len(resp.Responses) > 0 && resp.Responses[0].ResponseRange != nil && len(resp.Responses[0].ResponseRange.Kvs) > 0 {
+			if current, err := l.decodeLock(resp.Responses[0].ResponseRange.Kvs[0]); err == nil {
+				holder = current.String()
+			}
+		}
+		log.WithField("object", "etcd").WithField("mehtod", "lock").WithField("object", name).Debugf("lock is held by %s, waiting %s", holder, lockWait)
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("lock held by %s didn't disapear for %s", holder, lockTimeOut)
+			break
+		}
+		time.Sleep(lockWait)
+	}
+	// release the unused lease
+	rerr := doJSON(l.client, l.endpoints, http.MethodPost, "/v3/lease/revoke", map[string]string{"ID": lease.ID}, nil)
+	if rerr != nil {
+		log.WithField("object", "etcd").WithField("mehtod", "lock").WithField("object", name).Warnf("could not revoke lease: %s", rerr)
+	}
+	log.WithField("object", "etcd").WithField("mehtod", "lock").WithField("object", name).Errorf("could not lock: %s", err)
+	return fmt.Errorf("could not lock: %s", err)
+}
+
+// UnLock unlocks a resource
+func (l *etcdLocker) UnLock(name string) error {
+	log.WithField("object", "etcd").WithField("mehtod", "unlock").WithField("object", name).Debugf("unlocking object")
+	key := l.prefix + lockName(name)
+	l.locksLock.Lock()
+	held, ok := l.locks[key]
+	if ok {
+		close(held.stop)
+		delete(l.locks, key)
+	}
+	l.locksLock.Unlock()
+	if !ok {
+		log.WithField("object", "etcd").WithField("mehtod", "unlock").WithField("object", name).Errorf("lock not held by this server")
+		return fmt.Errorf("lock not held by this server")
+	}
+	<-held.done
+	l.locksLock.Lock()
+	lost := held.err
+	l.locksLock.Unlock()
+	// revoking the lease removes the key
+	err := doJSON(l.client, l.endpoints, http.MethodPost, "/v3/lease/revoke", map[string]string{"ID": held.lease}, nil)
+	if err != nil && lost == nil {
+		log.WithField("object", "etcd").WithField("mehtod", "unlock").WithField("object", name).Errorf("could not revoke lease: %s", err)
+		return fmt.Errorf("could not revoke lease: %s", err)
+	}
+	if lost != nil {
+		// the key went away with the lease while the lock was used
+		log.WithField("object", "etcd").WithField("mehtod", "unlock").WithField("object", name).Errorf("lock was lost: %s", lost)
+		return fmt.Errorf("lock was lost: %s", lost)
+	}
+	log.WithField("object", "etcd").WithField("mehtod", "unlock").WithField("object", name).Infof("unlocked")
+	return nil
+}
+
+// Held checks that a lock of this process is still held
+func (l *etcdLocker) Held(name string) error {
+	l.locksLock.Lock()
+	defer l.locksLock.Unlock()
+	held, ok := l.locks[l.prefix+lockName(name)]
+	if !ok {
+		return fmt.Errorf("lock not held by this server")
+	}
+	if held.err != nil {
+		return fmt.Errorf("lock was lost: %s", held.err)
+	}
+	return nil
+}
+
+// Locks gets the locks of the provided resources (all locks if none provided)
+func (l *etcdLocker) Locks(names ...string) ([]*LockInfo, error) {
+	ranges := make([]map[string]string, 0, len(names))
+	for _, name := range names {
+		ranges = append(ranges, map[string]string{"key": b64(l.prefix + lockName(name))})
+	}
+	if len(names) == 0 {
+		ranges = append(ranges, map[string]string{"key": b64(l.prefix), "range_end": b64(prefixEnd(l.prefix))})
+	}
+	infos := make([]*LockInfo, 0)
+	for _, r := range ranges {
+		resp := &etcdRangeResponse{}
+		err := doJSON(l.client, l.endpoints, http.MethodPost, "/v3/kv/range", r, resp)
+		if err != nil {
+			log.WithField("object", "etcd").WithField("mehtod", "locks").Errorf("could not list locks: %s", err)
+			return nil, fmt.Errorf("could not list locks: %s", err)
+		}
+		for _, kv := range resp.Kvs {
+			info, err := l.decodeLock(kv)
+			if err != nil {
+				return nil, fmt.Errorf("could not read lock: %s", err)
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// Break forcibly removes the lock of a resource
+func (l *etcdLocker) Break(name string) (*LockInfo, error) {
+	key := l.prefix + lockName(name)
+	resp := &struct {
+		PrevKvs []*etcdKeyValue `json:"prev_kvs"`
+	}{}
+	err := doJSON(l.client, l.endpoints, http.MethodPost, "/v3/kv/deleterange", map[string]interface{}{"key": b64(key), "prev_kv": true}, resp)
+	if err != nil {
+		log.WithField("object", "etcd").WithField("mehtod", "break").WithField("object", name).Errorf("could not remove lock: %s", err)
+		return nil, fmt.Errorf("could not remove lock '%s': %s", lockName(name), err)
+	}
+	if len(resp.PrevKvs) == 0 {
+		log.WithField("object", "etcd").WithField("mehtod", "break").WithField("object", name).Errorf("lock not found")
+		return nil, fmt.Errorf("lock '%s' not found", lockName(name))
+	}
+	info, err := l.decodeLock(resp.PrevKvs[0])
+	if err != nil {
+		info = &LockInfo{Object: lockName(name)}
+	}
+	log.WithField("object", "etcd").WithField("mehtod", "break").WithField("object", name).Warnf("broke lock held by %s", info)
+	return info, nil
+}
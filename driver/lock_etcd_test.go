@@ -0,0 +1,243 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort gets a free local tcp port
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startEtcd runs a single node etcd from the PATH and gets its client url
+// the tests are skipped without an etcd binary
+func startEtcd(t *testing.T) (string, *exec.Cmd) {
+	binary, err := exec.LookPath("etcd")
+	if err != nil {
+		t.Skip("no etcd binary in PATH")
+	}
+	dir, err := ioutil.TempDir("", "s3vol-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	client := fmt.Sprintf("http://127.0.0.1:%d", freePort(t))
+	peer := fmt.Sprintf("http://127.0.0.1:%d", freePort(t))
+	cmd := exec.Command(binary,
+		"--name", "s3vol",
+		"--data-dir", dir,
+		"--listen-client-urls", client,
+		"--advertise-client-urls", client,
+		"--listen-peer-urls", peer,
+		"--initial-advertise-peer-urls", peer,
+		"--initial-cluster", "s3vol="+peer,
+		"--log-level", "error",
+	)
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("could not start etcd: %s", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(client + "/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return client, cmd
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("etcd not ready on %s", client)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// withLockRenew shortens the lease renewals for a test
+func withLockRenew(t *testing.T, renew time.Duration) {
+	saved := lockRenew
+	lockRenew = renew
+	t.Cleanup(func() { lockRenew = saved })
+}
+
+// waitLost waits for a held lock to be reported as lost
+func waitLost(t *testing.T, l *etcdLocker, name string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Held(name) == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return l.Held(name)
+}
+
+func TestEtcdLockRenewed(t *testing.T) {
+	withLockRenew(t, 100*time.Millisecond)
+	endpoint, _ := startEtcd(t)
+	l, err := newEtcdLocker([]string{endpoint}, "s3vol/config/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Lock("volumes/test.json")
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+	// the lease would lose a second of time to live without renewals
+	time.Sleep(2500 * time.Millisecond)
+	locks, err := l.Locks()
+	if err != nil {
+		t.Fatalf("could not list locks: %s", err)
+	}
+	if len(locks) != 1 || locks[0].Object != "volumes/test.json.ext.lock" {
+		t.Fatalf("unexpected locks %v", locks)
+	}
+	if time.Until(locks[0].Expires) < lockTTL-1500*time.Millisecond {
+		t.Errorf("lease not kept alive: expires %s", locks[0].Expires)
+	}
+	err = l.Held("volumes/test.json")
+	if err != nil {
+		t.Errorf("lock not held: %s", err)
+	}
+	err = l.UnLock("volumes/test.json")
+	if err != nil {
+		t.Errorf("could not unlock: %s", err)
+	}
+	locks, err = l.Locks("volumes/test.json")
+	if err != nil || len(locks) > 0 {
+		t.Errorf("lock key not removed: %v, %v", locks, err)
+	}
+	if l.Held("volumes/test.json") == nil {
+		t.Errorf("lock still held after unlock")
+	}
+}
+
+func TestEtcdLockLost(t *testing.T) {
+	withLockRenew(t, 10*time.Millisecond)
+	endpoint, _ := startEtcd(t)
+	l, err := newEtcdLocker([]string{endpoint}, "s3vol/config/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		lose   func(held *etcdLock) error
+		reason string
+	}{
+		{
+			name: "expired lease",
+			lose: func(held *etcdLock) error {
+				return doJSON(l.client, l.endpoints, http.MethodPost, "/v3/lease/revoke", map[string]string{"ID": held.lease}, nil)
+			},
+			reason: "expired",
+		},
+		{
+			name: "broken lock",
+			lose: func(held *etcdLock) error {
+				_, err := l.Break("volumes/test.json")
+				return err
+			},
+			reason: "lock key removed",
+		},
+		{
+			name: "taken lock",
+			lose: func(held *etcdLock) error {
+				// another host replaces the key while the lease is still alive
+				lease := &etcdLeaseResponse{}
+				err := doJSON(l.client, l.endpoints, http.MethodPost, "/v3/lease/grant", map[string]string{"TTL": "30"}, lease)
+				if err != nil {
+					return err
+				}
+				value, _ := json.Marshal(&LockInfo{Object: "volumes/test.json.ext.lock", Owner: LockOwner{Hostname: "other"}})
+				return doJSON(l.client, l.endpoints, http.MethodPost, "/v3/kv/put", map[string]string{"key": b64("s3vol/config/volumes/test.json.ext.lock"), "value": b64(string(value)), "lease": lease.ID}, nil)
+			},
+			reason: "lock taken by other",
+		},
+	} {
+		err = l.Lock("volumes/test.json")
+		if err != nil {
+			t.Fatalf("%s: could not lock: %s", test.name, err)
+		}
+		l.locksLock.Lock()
+		held := l.locks["s3vol/config/volumes/test.json.ext.lock"]
+		l.locksLock.Unlock()
+		err = test.lose(held)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		err = waitLost(t, l, "volumes/test.json")
+		if err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("%s: lost lock reported as %v", test.name, err)
+		}
+		err = l.UnLock("volumes/test.json")
+		if err == nil || !strings.Contains(err.Error(), "lost") {
+			t.Errorf("%s: unlock of a lost lock didn't fail: %v", test.name, err)
+		}
+		// the lock of the other host is left
+		l.Break("volumes/test.json")
+	}
+	// the resource can be locked again
+	err = l.Lock("volumes/test.json")
+	if err != nil {
+		t.Fatalf("could not lock again: %s", err)
+	}
+	err = l.UnLock("volumes/test.json")
+	if err != nil {
+		t.Errorf("could not unlock: %s", err)
+	}
+}
+
+func TestEtcdLockUnreachable(t *testing.T) {
+	withLockRenew(t, 10*time.Millisecond)
+	endpoint, cmd := startEtcd(t)
+	l, err := newEtcdLocker([]string{endpoint}, "s3vol/config/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Lock("volumes/test.json")
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	if waitLost(t, l, "volumes/test.json") == nil {
+		t.Fatalf("lock still held without etcd")
+	}
+	if l.UnLock("volumes/test.json") == nil {
+		t.Errorf("unlock of a lost lock didn't fail")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		end    string
+	}{
+		{"s3vol/", "s3vol0"},
+		{"a", "b"},
+		{"a\xff", "b"},
+		{"\xff\xff", "\x00"},
+		{"", "\x00"},
+	}
+	for _, test := range tests {
+		end := prefixEnd(test.prefix)
+		if end != test.end {
+			t.Errorf("prefixEnd(%q) = %q, expected %q", test.prefix, end, test.end)
+		}
+	}
+}
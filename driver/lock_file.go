@@ -0,0 +1,259 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileLocker locks resources with flock on files of a local directory (single host setups)
+type fileLocker struct {
+	dir       string
+	files     map[string]*fileLock
+	filesLock sync.Mutex
+}
+
+// fileLock is a file lock held by this process
+type fileLock struct {
+	file *os.File
+	info *LockInfo
+}
+
+// newFileLocker creates a flock based locker
+func newFileLocker(dir string) (*fileLocker, error) {
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("no lock directory provided")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create lock directory %s: %s", dir, err)
+	}
+	return &fileLocker{
+		dir:   dir,
+		files: make(map[string]*fileLock),
+	}, nil
+}
+
+// path gets the path of the lock file of a resource
+func (l *fileLocker) path(name string) string {
+	return filepath.Join(l.dir, filepath.Clean("/"+lockName(name)))
+}
+
+// readLockFile reads the lock info from a lock file
+func readLockFile(path string) (*LockInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info := &LockInfo{}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, info)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// isHeld checks if a lock file is locked by a process
+func isHeld(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// sameFile checks that the locked file is still the lock file (it may have been broken)
+func sameFile(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, pi)
+}
+
+// Lock locks a resource
+func (l *fileLocker) Lock(name string) error {
+	log.WithField("object", "file").WithField("mehtod", "lock").WithField("object", name).Debugf("locking object")
+	path := l.path(name)
+	owner, err := getLockOwner()
+	if err != nil {
+		log.WithField("object", "file").WithField("mehtod", "lock").WithField("object", name).Errorf("could not get lock owner: %s", err)
+		return fmt.Errorf("could not get lock owner: %s", err)
+	}
+	token, err := newToken()
+	if err != nil {
+		log.WithField("object", "file").WithField("mehtod", "lock").WithField("object", name).Errorf("could not generate lock token: %s", err)
+		return fmt.Errorf("could not generate lock token: %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		log.WithField("object", "file").WithField("mehtod", "lock").WithField("object", name).Errorf("could not create lock directory: %s", err)
+		return fmt.Errorf("could not create lock directory: %s", err)
+	}
+	deadline := time.Now().Add(lockTimeOut)
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			log.WithField("object", "file").WithField("mehtod", "lock").WithField("object", name).Errorf("could not open lock file: %s", err)
+			return fmt.Errorf("could not open lock file: %s", err)
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil && sameFile(f, path) {
+			info := &LockInfo{Object: lockName(name), Owner: *owner, Token: token}
+			data, err := json.Marshal(info)
+			if err == nil {
+				err = f.Truncate(0)
+			}
+			if err == nil {
+				_, err = f.WriteAt(data, 0)
+			}
+			if err != nil {
+				f.Close()
+				log.WithField("object", "file").WithField("mehtod", "lock").WithField("object", name).Errorf("could not write lock file: %s", err)
+				return fmt.Errorf("could not write lock file: %s", err)
+			}
+			l.filesLock.Lock()
+			l.files[path] = &fileLock{file: f, info: info}
+			l.filesLock.Unlock()
+			log.WithField("object", "file").WithField("mehtod", "lock").WithField("object", name).Infof("locked")
+			return nil
+		}
+		f.Close()
+		if err != nil && err != syscall.EWOULDBLOCK {
+			log.WithField("object", "file").WithField("mehtod", "lock").WithField("object", name).Errorf("could not lock file: %s", err)
+			return fmt.Errorf("could not lock file: %s", err)
+		}
+		if time.Now().After(deadline) {
+			holder := "unknown"
+			if info, err := readLockFile(path); err == nil {
+				holder = info.String()
+			}
+			log.WithField("object", "file").WithField("mehtod", "lock").WithField("object", name).Errorf("lock held by %s didn't disapear for %s", holder, lockTimeOut)
+			return fmt.Errorf("lock held by %s didn't disapear for %s", holder, lockTimeOut)
+		}
+		time.Sleep(lockWait)
+	}
+}
+
+// UnLock unlocks a resource
+func (l *fileLocker) UnLock(name string) error {
+	log.WithField("object", "file").WithField("mehtod", "unlock").WithField("object", name).Debugf("unlocking object")
+	path := l.path(name)
+	l.filesLock.Lock()
+	held, ok := l.files[path]
+	delete(l.files, path)
+	l.filesLock.Unlock()
+	if !ok {
+		log.WithField("object", "file").WithField("mehtod", "unlock").WithField("object", name).Errorf("lock not held by this server")
+		return fmt.Errorf("lock not held by this server")
+	}
+	defer held.file.Close()
+	err := held.file.Truncate(0)
+	if err != nil {
+		log.WithField("object", "file").WithField("mehtod", "unlock").WithField("object", name).Warnf("could not clear lock file: %s", err)
+	}
+	err = syscall.Flock(int(held.file.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		log.WithField("object", "file").WithField("mehtod", "unlock").WithField("object", name).Errorf("could not unlock file: %s", err)
+		return fmt.Errorf("could not unlock file: %s", err)
+	}
+	log.WithField("object", "file").WithField("mehtod", "unlock").WithField("object", name).Infof("unlocked")
+	return nil
+}
+
+// Held checks that a lock of this process is still held (flocks don't expire)
+func (l *fileLocker) Held(name string) error {
+	l.filesLock.Lock()
+	defer l.filesLock.Unlock()
+	if _, ok := l.files[l.path(name)]; !ok {
+		return fmt.Errorf("lock not held by this server")
+	}
+	return nil
+}
+
+// Locks gets the held locks of the provided resources (all locks if none provided)
+func (l *fileLocker) Locks(names ...string) ([]*LockInfo, error) {
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		paths = append(paths, l.path(name))
+	}
+	if len(names) == 0 {
+		err := filepath.Walk(l.dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && strings.HasSuffix(path, lockExt) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			log.WithField("object", "file").WithField("mehtod", "locks").Errorf("could not list locks: %s", err)
+			return nil, fmt.Errorf("could not list locks: %s", err)
+		}
+	}
+	infos := make([]*LockInfo, 0, len(paths))
+	for _, path := range paths {
+		held, err := isHeld(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not check lock '%s': %s", path, err)
+		}
+		if !held {
+			continue
+		}
+		info, err := readLockFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read lock '%s': %s", path, err)
+		}
+		if len(info.Object) == 0 {
+			rel, _ := filepath.Rel(l.dir, path)
+			info.Object = filepath.ToSlash(rel)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Break forcibly removes the lock file of a resource
+func (l *fileLocker) Break(name string) (*LockInfo, error) {
+	path := l.path(name)
+	info, err := readLockFile(path)
+	if err != nil {
+		log.WithField("object", "file").WithField("mehtod", "break").WithField("object", name).Errorf("could not read lock: %s", err)
+		return nil, fmt.Errorf("could not read lock '%s': %s", lockName(name), err)
+	}
+	// the holder keeps the lock on the removed file, new lockers use a new file
+	err = os.Remove(path)
+	if err != nil {
+		log.WithField("object", "file").WithField("mehtod", "break").WithField("object", name).Errorf("could not remove lock: %s", err)
+		return nil, fmt.Errorf("could not remove lock '%s': %s", lockName(name), err)
+	}
+	info.Object = lockName(name)
+	log.WithField("object", "file").WithField("mehtod", "break").WithField("object", name).Warnf("broke lock held by %s", info)
+	return info, nil
+}
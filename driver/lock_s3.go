@@ -0,0 +1,379 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+)
+
+// s3Locker locks resources with lock objects in the config bucket
+type s3Locker struct {
+	client             *minio.Client
+	bucket             string
+	locks              map[string]*heldLock
+	locksLock          sync.Mutex
+	unconditionalLocks int32
+	// allowUnconditional falls back to unsafe locks on endpoints without conditional writes
+	allowUnconditional bool
+}
+
+// heldLock is a lock held by this process
+type heldLock struct {
+	info *LockInfo
+	// err tells why the lease could not be renewed
+	err  error
+	stop chan struct{}
+	done chan struct{}
+}
+
+// conditionKey is the context key of the conditional headers of a request
+type conditionKey struct{}
+
+// conditionalTransport adds conditional headers (If-None-Match, If-Match) to PUT requests
+type conditionalTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip adds the conditional headers found in the request context
+func (t *conditionalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if headers, ok := req.Context().Value(conditionKey{}).(map[string]string); ok && req.Method == http.MethodPut {
+		req = req.Clone(req.Context())
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// newS3Locker creates a s3 object locker
+func newS3Locker(clt *minio.Client, bucket string, allowUnconditional bool) *s3Locker {
+	return &s3Locker{
+		client:             clt,
+		bucket:             bucket,
+		locks:              make(map[string]*heldLock),
+		allowUnconditional: allowUnconditional,
+	}
+}
+
+// isPreconditionFailed checks if the error is a failed conditional write
+func isPreconditionFailed(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.StatusCode == http.StatusPreconditionFailed || resp.Code == "PreconditionFailed"
+}
+
+// isNotImplemented checks if the error is an unsupported conditional write
+func isNotImplemented(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.StatusCode == http.StatusNotImplemented || resp.Code == "NotImplemented"
+}
+
+// readLock reads a lock object, returns nil if the lock doesn't exist
+func (l *s3Locker) readLock(lock string) (*LockInfo, error) {
+	obj, err := l.client.GetObject(l.bucket, lock, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	stat, err := obj.Stat()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	_, err = buf.ReadFrom(obj)
+	if err != nil {
+		return nil, err
+	}
+	info := &LockInfo{}
+	err = json.Unmarshal(buf.Bytes(), info)
+	if err != nil {
+		// lock from a former version: the content is the hostname
+		info = &LockInfo{Owner: LockOwner{Hostname: buf.String()}, Expires: stat.LastModified.Add(lockTTL)}
+	}
+	info.Object = lock
+	info.etag = stat.ETag
+	return info, nil
+}
+
+// writeLock writes a lock object with the provided conditional headers
+func (l *s3Locker) writeLock(lock string, info *LockInfo, headers map[string]string) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	conditional := atomic.LoadInt32(&l.unconditionalLocks) == 0
+	if len(headers) > 0 && conditional {
+		ctx = context.WithValue(ctx, conditionKey{}, headers)
+	}
+	reader := bytes.NewReader(data)
+	_, err = l.client.PutObjectWithContext(ctx, l.bucket, lock, reader, reader.Size(), minio.PutObjectOptions{ContentType: "application/json"})
+	if err != nil && isNotImplemented(err) && conditional && len(headers) > 0 {
+		// two hosts could both take a lock written without conditions
+		if !l.allowUnconditional {
+			log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", lock).Errorf("conditional writes not supported by the endpoint: use another lock backend or allow unconditional locks")
+			return fmt.Errorf("conditional writes not supported by the endpoint: use another lock backend or allow unconditional locks")
+		}
+		log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", lock).Errorf("conditional writes not supported by the endpoint, falling back to UNSAFE unconditional locks: concurrent changes can be lost")
+		atomic.StoreInt32(&l.unconditionalLocks, 1)
+		return l.writeLock(lock, info, headers)
+	}
+	return err
+}
+
+// tryLock tries once to acquire a lock, returns the current holder if it is held
+func (l *s3Locker) tryLock(lock string, info *LockInfo) (*LockInfo, error) {
+	current, err := l.readLock(lock)
+	if err != nil {
+		return nil, fmt.Errorf("could not get lock: %s", err)
+	}
+	switch {
+	case current == nil:
+		// lock should not exist
+		err = l.writeLock(lock, info, map[string]string{"If-None-Match": "*"})
+	case current.expired():
+		// take over a stale lock: it should not have changed since read
+		log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", lock).Warnf("taking over expired lock held by %s", current)
+		err = l.writeLock(lock, info, map[string]string{"If-Match": current.etag})
+	default:
+		return current, nil
+	}
+	if err != nil && !isPreconditionFailed(err) {
+		return nil, fmt.Errorf("could not put lock: %s", err)
+	}
+	// read back the lock to check ownership (endpoints may ignore conditions)
+	// a failed condition is also the retry of a conditional write that succeeded
+	current, err = l.readLock(lock)
+	if err != nil {
+		return nil, fmt.Errorf("could not get lock: %s", err)
+	}
+	if current == nil {
+		// released in the mean time
+		return &LockInfo{Object: lock}, nil
+	}
+	if !info.owns(current) {
+		// somebody else was faster
+		return current, nil
+	}
+	info.etag = current.etag
+	return nil, nil
+}
+
+// renewLock renews the lease of a held lock until stopped
+func (l *s3Locker) renewLock(lock string, held *heldLock) {
+	defer close(held.done)
+	ticker := time.NewTicker(lockRenew)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-held.stop:
+			return
+		case <-ticker.C:
+		}
+		l.locksLock.Lock()
+		info := *held.info
+		l.locksLock.Unlock()
+		info.Expires = time.Now().Add(lockTTL)
+		err := l.writeLock(lock, &info, map[string]string{"If-Match": info.etag})
+		if err == nil || isPreconditionFailed(err) {
+			// check ownership: a failed condition may be the retry of a renewal that succeeded
+			var current *LockInfo
+			current, err = l.readLock(lock)
+			if err == nil && !info.owns(current) {
+				err = fmt.Errorf("lock taken over by %s", current)
+			}
+			if err == nil {
+				info.etag = current.etag
+				l.locksLock.Lock()
+				held.info = &info
+				l.locksLock.Unlock()
+			}
+		}
+		if err != nil {
+			log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", lock).Errorf("could not renew lock: %s", err)
+			// the holder learns it from Held and UnLock
+			l.locksLock.Lock()
+			held.err = err
+			l.locksLock.Unlock()
+			return
+		}
+		log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", lock).Debugf("renewed lock until %s", info.Expires.UTC().Format(time.RFC3339))
+	}
+}
+
+// Lock locks an object
+func (l *s3Locker) Lock(object string) error {
+	log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", object).Debugf("locking object")
+	lock := lockName(object)
+	owner, err := getLockOwner()
+	if err != nil {
+		log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", object).Errorf("could not get lock owner: %s", err)
+		return fmt.Errorf("could not get lock owner: %s", err)
+	}
+	token, err := newToken()
+	if err != nil {
+		log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", object).Errorf("could not generate lock token: %s", err)
+		return fmt.Errorf("could not generate lock token: %s", err)
+	}
+	// loop while the lock is held by somebody else
+	deadline := time.Now().Add(lockTimeOut)
+	for {
+		info := &LockInfo{Object: lock, Owner: *owner, Token: token, Expires: time.Now().Add(lockTTL)}
+		holder, err := l.tryLock(lock, info)
+		if err != nil {
+			log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", lock).Errorf("%s", err)
+			return err
+		}
+		if holder == nil {
+			// obtained the lock
+			held := &heldLock{info: info, stop: make(chan struct{}), done: make(chan struct{})}
+			l.locksLock.Lock()
+			l.locks[lock] = held
+			l.locksLock.Unlock()
+			go l.renewLock(lock, held)
+			if atomic.LoadInt32(&l.unconditionalLocks) != 0 {
+				log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", object).Warnf("locked without conditional writes (unsafe)")
+			}
+			log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", object).Infof("locked")
+			return nil
+		}
+		log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", lock).Debugf("lock is held by %s, waiting %s", holder, lockWait)
+		if time.Now().After(deadline) {
+			log.WithField("object", "minio").WithField("mehtod", "lock").WithField("bucket", l.bucket).WithField("object", lock).Errorf("lock held by %s didn't disapear for %s", holder, lockTimeOut)
+			return fmt.Errorf("lock held by %s didn't disapear for %s", holder, lockTimeOut)
+		}
+		time.Sleep(lockWait)
+	}
+}
+
+// UnLock unlocks an object
+func (l *s3Locker) UnLock(object string) error {
+	log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", l.bucket).WithField("object", object).Debugf("unlocking object")
+	lock := lockName(object)
+	// stop renewing the lease
+	l.locksLock.Lock()
+	held, ok := l.locks[lock]
+	if ok {
+		close(held.stop)
+		delete(l.locks, lock)
+	}
+	l.locksLock.Unlock()
+	if !ok {
+		log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", l.bucket).WithField("object", lock).Errorf("lock not held by this server")
+		return fmt.Errorf("lock not held by this server")
+	}
+	// wait for a renewal in progress
+	<-held.done
+	l.locksLock.Lock()
+	lost := held.err
+	l.locksLock.Unlock()
+	// check existance of the lock
+	current, err := l.readLock(lock)
+	if err != nil {
+		log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", l.bucket).WithField("object", lock).Errorf("could not get lock: %s", err)
+		return fmt.Errorf("could not get lock: %s", err)
+	}
+	switch {
+	case current == nil:
+		log.WithField("object", "minio").WithField("mehtod", "ulock").WithField("bucket", l.bucket).WithField("object", object).Warnf("lock disapeared")
+	case !held.info.owns(current):
+		log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", l.bucket).WithField("object", lock).Errorf("lock taken over by %s", current)
+		return fmt.Errorf("lock taken over by %s", current)
+	default:
+		// remove the lock
+		err = l.client.RemoveObject(l.bucket, lock)
+		if err != nil {
+			log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", l.bucket).WithField("object", lock).Errorf("could not remove lock: %s", err)
+			return fmt.Errorf("could not remove lock: %s", err)
+		}
+	}
+	if lost != nil {
+		// the lease may have expired while the lock was used
+		log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", l.bucket).WithField("object", lock).Errorf("lock was lost: %s", lost)
+		return fmt.Errorf("lock was lost: %s", lost)
+	}
+	// unlocked
+	log.WithField("object", "minio").WithField("mehtod", "unlock").WithField("bucket", l.bucket).WithField("object", object).Infof("unlocked")
+	return nil
+}
+
+// Held checks that a lock of this process is still held
+func (l *s3Locker) Held(object string) error {
+	lock := lockName(object)
+	l.locksLock.Lock()
+	defer l.locksLock.Unlock()
+	held, ok := l.locks[lock]
+	if !ok {
+		return fmt.Errorf("lock not held by this server")
+	}
+	if held.err != nil {
+		return fmt.Errorf("lock was lost: %s", held.err)
+	}
+	return nil
+}
+
+// Locks gets the locks of the provided objects of the config bucket (all locks if none provided)
+func (l *s3Locker) Locks(objects ...string) ([]*LockInfo, error) {
+	locks := make([]string, 0, len(objects))
+	for _, object := range objects {
+		locks = append(locks, lockName(object))
+	}
+	if len(objects) == 0 {
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		for object := range l.client.ListObjectsV2(l.bucket, "", true, doneCh) {
+			if object.Err != nil {
+				log.WithField("object", "minio").WithField("mehtod", "locks").WithField("bucket", l.bucket).Errorf("could not list locks: %s", object.Err)
+				return nil, fmt.Errorf("could not list locks: %s", object.Err)
+			}
+			if strings.HasSuffix(object.Key, lockExt) {
+				locks = append(locks, object.Key)
+			}
+		}
+	}
+	infos := make([]*LockInfo, 0, len(locks))
+	for _, lock := range locks {
+		info, err := l.readLock(lock)
+		if err != nil {
+			log.WithField("object", "minio").WithField("mehtod", "locks").WithField("bucket", l.bucket).WithField("object", lock).Errorf("could not get lock: %s", err)
+			return nil, fmt.Errorf("could not get lock '%s': %s", lock, err)
+		}
+		if info == nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Break forcibly removes the lock of an object of the config bucket
+func (l *s3Locker) Break(object string) (*LockInfo, error) {
+	lock := lockName(object)
+	info, err := l.readLock(lock)
+	if err != nil {
+		log.WithField("object", "minio").WithField("mehtod", "break").WithField("bucket", l.bucket).WithField("object", lock).Errorf("could not get lock: %s", err)
+		return nil, fmt.Errorf("could not get lock '%s': %s", lock, err)
+	}
+	if info == nil {
+		log.WithField("object", "minio").WithField("mehtod", "break").WithField("bucket", l.bucket).WithField("object", lock).Errorf("lock not found")
+		return nil, fmt.Errorf("lock '%s' not found", lock)
+	}
+	err = l.client.RemoveObject(l.bucket, lock)
+	if err != nil {
+		log.WithField("object", "minio").WithField("mehtod", "break").WithField("bucket", l.bucket).WithField("object", lock).Errorf("could not remove lock: %s", err)
+		return nil, fmt.Errorf("could not remove lock '%s': %s", lock, err)
+	}
+	log.WithField("object", "minio").WithField("mehtod", "break").WithField("bucket", l.bucket).WithField("object", lock).Warnf("broke lock held by %s", info)
+	return info, nil
+}
@@ -0,0 +1,236 @@
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+)
+
+// hidingHandler hides objects from the first reads, as if written in the mean time
+type hidingHandler struct {
+	*s3Stub
+	hide int32
+}
+
+func (h *hidingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && atomic.AddInt32(&h.hide, -1) >= 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	h.s3Stub.ServeHTTP(w, r)
+}
+
+// newLockStub gets an s3 stub for the locks of the config bucket
+func newLockStub() *s3Stub {
+	return &s3Stub{objects: map[string][]byte{}, buckets: map[string]time.Time{"s3vol": time.Now()}}
+}
+
+// newTestS3Locker gets a s3 locker on a handler with the conditional transport of the driver
+func newTestS3Locker(t *testing.T, handler http.Handler, allowUnconditional bool) *s3Locker {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	clt, err := minio.NewWithRegion(strings.TrimPrefix(srv.URL, "http://"), "a", "b", false, "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt.SetCustomTransport(&conditionalTransport{RoundTripper: http.DefaultTransport})
+	return newS3Locker(clt, "s3vol", allowUnconditional)
+}
+
+// stubLock reads a lock object of the stub
+func stubLock(t *testing.T, stub *s3Stub, object string) *LockInfo {
+	stub.Lock()
+	defer stub.Unlock()
+	data, ok := stub.objects["s3vol/"+lockName(object)]
+	if !ok {
+		return nil
+	}
+	info := &LockInfo{}
+	err := json.Unmarshal(data, info)
+	if err != nil {
+		t.Fatalf("invalid lock %q: %s", data, err)
+	}
+	return info
+}
+
+// putStubLock writes a lock object held by another host
+func putStubLock(stub *s3Stub, object string, expires time.Time) string {
+	data, _ := json.Marshal(&LockInfo{Object: lockName(object), Owner: LockOwner{Hostname: "other"}, Token: "other", Expires: expires})
+	stub.Lock()
+	defer stub.Unlock()
+	stub.objects["s3vol/"+lockName(object)] = data
+	return strings.Trim(stubETag(data), `"`)
+}
+
+// stubConditions gets the conditional headers received by the stub
+func stubConditions(stub *s3Stub) []string {
+	stub.Lock()
+	defer stub.Unlock()
+	return append([]string{}, stub.conditions...)
+}
+
+func TestS3LockConditional(t *testing.T) {
+	stub := newLockStub()
+	l := newTestS3Locker(t, stub, false)
+	err := l.Lock("volumes/test.json")
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+	conditions := stubConditions(stub)
+	if len(conditions) != 1 || conditions[0] != "If-None-Match: *" {
+		t.Errorf("lock written with conditions %v", conditions)
+	}
+	info := stubLock(t, stub, "volumes/test.json")
+	if info == nil || len(info.Token) == 0 {
+		t.Fatalf("lock not written: %v", info)
+	}
+	// another host doesn't get the lock
+	other := newTestS3Locker(t, stub, false)
+	holder, err := other.tryLock(lockName("volumes/test.json"), &LockInfo{Owner: LockOwner{Hostname: "other"}, Token: "other", Expires: time.Now().Add(lockTTL)})
+	if err != nil || holder == nil || holder.Token != info.Token {
+		t.Errorf("lock held by %v obtained by another host: %v, %v", info, holder, err)
+	}
+	err = l.UnLock("volumes/test.json")
+	if err != nil {
+		t.Errorf("could not unlock: %s", err)
+	}
+	if stubLock(t, stub, "volumes/test.json") != nil {
+		t.Errorf("lock not removed")
+	}
+}
+
+func TestS3LockPreconditionFailed(t *testing.T) {
+	stub := newLockStub()
+	putStubLock(stub, "volumes/test.json", time.Now().Add(lockTTL))
+	// the lock of the other host is only seen after the write
+	l := newTestS3Locker(t, &hidingHandler{s3Stub: stub, hide: 1}, false)
+	info := &LockInfo{Object: lockName("volumes/test.json"), Token: "token", Expires: time.Now().Add(lockTTL)}
+	holder, err := l.tryLock(lockName("volumes/test.json"), info)
+	if err != nil {
+		t.Fatalf("failed condition not handled: %s", err)
+	}
+	if holder == nil || holder.Token != "other" {
+		t.Errorf("lock obtained over the lock of another host: %v", holder)
+	}
+	conditions := stubConditions(stub)
+	if len(conditions) != 1 || conditions[0] != "If-None-Match: *" {
+		t.Errorf("lock written with conditions %v", conditions)
+	}
+	if current := stubLock(t, stub, "volumes/test.json"); current == nil || current.Token != "other" {
+		t.Errorf("lock of another host replaced by %v", current)
+	}
+}
+
+func TestS3LockExpired(t *testing.T) {
+	stub := newLockStub()
+	etag := putStubLock(stub, "volumes/test.json", time.Now().Add(-time.Second))
+	l := newTestS3Locker(t, stub, false)
+	err := l.Lock("volumes/test.json")
+	if err != nil {
+		t.Fatalf("could not take over expired lock: %s", err)
+	}
+	conditions := stubConditions(stub)
+	if len(conditions) != 1 || conditions[0] != "If-Match: "+etag {
+		t.Errorf("expired lock taken over with conditions %v, expected If-Match: %s", conditions, etag)
+	}
+	if info := stubLock(t, stub, "volumes/test.json"); info == nil || info.Token == "other" {
+		t.Errorf("expired lock not taken over: %v", info)
+	}
+	err = l.UnLock("volumes/test.json")
+	if err != nil {
+		t.Errorf("could not unlock: %s", err)
+	}
+}
+
+func TestS3LockRenewed(t *testing.T) {
+	withLockRenew(t, 20*time.Millisecond)
+	stub := newLockStub()
+	l := newTestS3Locker(t, stub, false)
+	err := l.Lock("volumes/test.json")
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+	first := stubLock(t, stub, "volumes/test.json")
+	time.Sleep(200 * time.Millisecond)
+	renewed := stubLock(t, stub, "volumes/test.json")
+	if renewed == nil || !renewed.Expires.After(first.Expires) || renewed.Token != first.Token {
+		t.Errorf("lock not renewed: %v then %v", first, renewed)
+	}
+	conditions := stubConditions(stub)
+	if len(conditions) < 2 || !strings.HasPrefix(conditions[1], "If-Match: ") {
+		t.Errorf("lock renewed with conditions %v", conditions)
+	}
+	err = l.Held("volumes/test.json")
+	if err != nil {
+		t.Errorf("lock not held: %s", err)
+	}
+	err = l.UnLock("volumes/test.json")
+	if err != nil {
+		t.Errorf("could not unlock: %s", err)
+	}
+}
+
+func TestS3LockTakenOver(t *testing.T) {
+	withLockRenew(t, 20*time.Millisecond)
+	stub := newLockStub()
+	l := newTestS3Locker(t, stub, false)
+	err := l.Lock("volumes/test.json")
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+	// another host took the lock over
+	putStubLock(stub, "volumes/test.json", time.Now().Add(lockTTL))
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Held("volumes/test.json") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = l.Held("volumes/test.json")
+	if err == nil || !strings.Contains(err.Error(), "taken over by other") {
+		t.Errorf("lost lock reported as %v", err)
+	}
+	err = l.UnLock("volumes/test.json")
+	if err == nil || !strings.Contains(err.Error(), "taken over by other") {
+		t.Errorf("unlock of a lost lock didn't fail: %v", err)
+	}
+	if info := stubLock(t, stub, "volumes/test.json"); info == nil || info.Token != "other" {
+		t.Errorf("lock of another host removed: %v", info)
+	}
+}
+
+func TestS3LockNotImplemented(t *testing.T) {
+	stub := newLockStub()
+	stub.unconditional = true
+	l := newTestS3Locker(t, stub, false)
+	err := l.Lock("volumes/test.json")
+	if err == nil || !strings.Contains(err.Error(), "conditional writes not supported") {
+		t.Errorf("lock without conditional writes didn't fail: %v", err)
+	}
+	if info := stubLock(t, stub, "volumes/test.json"); info != nil {
+		t.Errorf("lock written without conditions: %v", info)
+	}
+	if atomic.LoadInt32(&l.unconditionalLocks) != 0 {
+		t.Errorf("switched to unconditional locks")
+	}
+	// unsafe locks are allowed explicitly
+	l = newTestS3Locker(t, stub, true)
+	err = l.Lock("volumes/test.json")
+	if err != nil {
+		t.Fatalf("could not lock without conditional writes: %s", err)
+	}
+	if atomic.LoadInt32(&l.unconditionalLocks) == 0 {
+		t.Errorf("not switched to unconditional locks")
+	}
+	if info := stubLock(t, stub, "volumes/test.json"); info == nil {
+		t.Errorf("lock not written")
+	}
+	err = l.UnLock("volumes/test.json")
+	if err != nil {
+		t.Errorf("could not unlock: %s", err)
+	}
+}
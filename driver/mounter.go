@@ -0,0 +1,311 @@
+package driver
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	backendOption     = "backend"
+	backendS3fs       = "s3fs"
+	backendGoofys     = "goofys"
+	backendRclone     = "rclone"
+	backendMountpoint = "mountpoint-s3"
+	// backendNative is the filesystem of the plugin process
+	backendNative = "native"
+	// cacheOption is the local cache directory of all the backends
+	cacheOption = "cache"
+)
+
+//Mounter mounts the bucket of a volume with a fuse filesystem
+type Mounter interface {
+	// Binary is the name of the mount executable
+	Binary() string
+	// Options are the volume options accepted by the backend and their kinds
+	Options() map[string]int
+	// Command gets the foreground command serving the mount of a volume
+	Command(binary string, spec *mountSpec) *exec.Cmd
+}
+
+// mountSpec is the mount of a volume given to a mounter
+type mountSpec struct {
+	backend    string
+	binary     string
+	bucket     string
+	prefix     string
+	mountpoint string
+	// endpoint is the url of the s3 endpoint
+	endpoint string
+	region   string
+	options  map[string]string
+	env      []string
+}
+
+// commonOptions are the volume options translated by all the backends
+var commonOptions = map[string]int{
+	"uid":         optInt,
+	"gid":         optInt,
+	"umask":       optOctal,
+	"ro":          optFlag,
+	"allow_other": optFlag,
+	cacheOption:   optPath,
+}
+
+// mounters are the available mount backends
+var mounters = map[string]Mounter{
+	backendS3fs:       s3fsMounter{},
+	backendGoofys:     goofysMounter{},
+	backendRclone:     rcloneMounter{},
+	backendMountpoint: mountpointMounter{},
+}
+
+// backendNames gets the names of the mount backends
+func backendNames() []string {
+	names := make([]string, 0, len(mounters)+1)
+	for name := range mounters {
+		names = append(names, name)
+	}
+	names = append(names, backendNative)
+	sort.Strings(names)
+	return names
+}
+
+// checkBackend checks that a mount backend exists
+func checkBackend(backend string) error {
+	if _, ok := mounters[backend]; !ok && backend != backendNative {
+		return fmt.Errorf("unknown backend '%s': use %s", backend, strings.Join(backendNames(), ", "))
+	}
+	return nil
+}
+
+// splitBackend separates the mount backend from the volume options
+func splitBackend(options map[string]string) (string, map[string]string, error) {
+	backend, ok := options[backendOption]
+	if !ok {
+		return "", options, nil
+	}
+	if err := checkBackend(backend); err != nil {
+		return "", nil, err
+	}
+	opts := make(map[string]string)
+	for k, v := range options {
+		if k != backendOption {
+			opts[k] = v
+		}
+	}
+	return backend, opts, nil
+}
+
+// backendOptions gets the volume options accepted by a backend
+func backendOptions(backend string) map[string]int {
+	if backend == backendNative {
+		return nativeOptions
+	}
+	return mounters[backend].Options()
+}
+
+// volumeBackend gets the backend mounting a volume
+func (d *S3fsDriver) volumeBackend(volConfig *VolConfig) string {
+	if len(volConfig.Backend) > 0 {
+		return volConfig.Backend
+	}
+	return d.Backend
+}
+
+// backendPath gets the path of the mount executable of a backend
+func (d *S3fsDriver) backendPath(backend string) (string, error) {
+	if backend == backendNative {
+		// mounted in process
+		return "", nil
+	}
+	if backend == backendS3fs {
+		if len(d.s3fspath) == 0 {
+			return "", fmt.Errorf("could not get s3fs path: provide s3fs path or install it")
+		}
+		return d.s3fspath, nil
+	}
+	path, err := exec.LookPath(mounters[backend].Binary())
+	if err != nil {
+		return "", fmt.Errorf("could not find %s for backend %s: %s", mounters[backend].Binary(), backend, err)
+	}
+	return path, nil
+}
+
+// isMountBinary checks if an executable is one of the mount backends
+func isMountBinary(name string) bool {
+	for _, m := range mounters {
+		if m.Binary() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFlag checks if a flag option is set
+func hasFlag(options map[string]string, name string) bool {
+	value, ok := options[name]
+	return ok && value != "false"
+}
+
+// fileModes gets the file and directory modes from a umask
+func fileModes(umask string) (string, string) {
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil {
+		mask = 0022
+	}
+	return fmt.Sprintf("%04o", 0666&^mask), fmt.Sprintf("%04o", 0777&^mask)
+}
+
+// s3fsMounter mounts with s3fs
+type s3fsMounter struct{}
+
+func (s3fsMounter) Binary() string { return "s3fs" }
+
+func (s3fsMounter) Options() map[string]int { return s3fsOptions }
+
+func (s3fsMounter) Command(binary string, spec *mountSpec) *exec.Cmd {
+	source := spec.bucket
+	if len(spec.prefix) > 0 {
+		source = fmt.Sprintf("%s:/%s", spec.bucket, spec.prefix)
+	}
+	options := make(map[string]string, len(spec.options))
+	for k, v := range spec.options {
+		options[k] = v
+	}
+	if cache, ok := options[cacheOption]; ok {
+		delete(options, cacheOption)
+		options["use_cache"] = cache
+	}
+	return exec.Command(binary, source, spec.mountpoint, "-f", "-o", OptionsToString(options))
+}
+
+// goofysMounter mounts with goofys
+type goofysMounter struct{}
+
+func (goofysMounter) Binary() string { return "goofys" }
+
+func (goofysMounter) Options() map[string]int { return commonOptions }
+
+func (goofysMounter) Command(binary string, spec *mountSpec) *exec.Cmd {
+	args := []string{"-f"}
+	if len(spec.endpoint) > 0 {
+		args = append(args, "--endpoint", spec.endpoint)
+	}
+	if len(spec.region) > 0 {
+		args = append(args, "--region", spec.region)
+	}
+	if uid, ok := spec.options["uid"]; ok {
+		args = append(args, "--uid", uid)
+	}
+	if gid, ok := spec.options["gid"]; ok {
+		args = append(args, "--gid", gid)
+	}
+	if umask, ok := spec.options["umask"]; ok {
+		file, dir := fileModes(umask)
+		args = append(args, "--file-mode", file, "--dir-mode", dir)
+	}
+	if cache, ok := spec.options[cacheOption]; ok {
+		args = append(args, "--cache", cache)
+	}
+	if hasFlag(spec.options, "ro") {
+		args = append(args, "-o", "ro")
+	}
+	if hasFlag(spec.options, "allow_other") {
+		args = append(args, "-o", "allow_other")
+	}
+	source := spec.bucket
+	if len(spec.prefix) > 0 {
+		source = fmt.Sprintf("%s:%s", spec.bucket, spec.prefix)
+	}
+	args = append(args, source, spec.mountpoint)
+	return exec.Command(binary, args...)
+}
+
+// rcloneMounter mounts with rclone mount
+type rcloneMounter struct{}
+
+func (rcloneMounter) Binary() string { return "rclone" }
+
+func (rcloneMounter) Options() map[string]int { return commonOptions }
+
+func (rcloneMounter) Command(binary string, spec *mountSpec) *exec.Cmd {
+	source := ":s3:" + spec.bucket
+	if len(spec.prefix) > 0 {
+		source += "/" + spec.prefix
+	}
+	// files are written through the vfs cache to allow random writes
+	args := []string{"mount", source, spec.mountpoint, "--vfs-cache-mode", "writes"}
+	if uid, ok := spec.options["uid"]; ok {
+		args = append(args, "--uid", uid)
+	}
+	if gid, ok := spec.options["gid"]; ok {
+		args = append(args, "--gid", gid)
+	}
+	if umask, ok := spec.options["umask"]; ok {
+		args = append(args, "--umask", umask)
+	}
+	if cache, ok := spec.options[cacheOption]; ok {
+		args = append(args, "--cache-dir", cache)
+	}
+	if hasFlag(spec.options, "ro") {
+		args = append(args, "--read-only")
+	}
+	if hasFlag(spec.options, "allow_other") {
+		args = append(args, "--allow-other")
+	}
+	cmd := exec.Command(binary, args...)
+	// the on the fly remote is configured by the environment
+	cmd.Env = append(cmd.Env, "RCLONE_S3_PROVIDER=Other", "RCLONE_S3_ENV_AUTH=true")
+	if len(spec.endpoint) > 0 {
+		cmd.Env = append(cmd.Env, "RCLONE_S3_ENDPOINT="+spec.endpoint)
+	}
+	if len(spec.region) > 0 {
+		cmd.Env = append(cmd.Env, "RCLONE_S3_REGION="+spec.region)
+	}
+	return cmd
+}
+
+// mountpointMounter mounts with mountpoint-s3
+type mountpointMounter struct{}
+
+func (mountpointMounter) Binary() string { return "mount-s3" }
+
+func (mountpointMounter) Options() map[string]int { return commonOptions }
+
+func (mountpointMounter) Command(binary string, spec *mountSpec) *exec.Cmd {
+	args := []string{spec.bucket, spec.mountpoint, "--foreground", "--force-path-style"}
+	if len(spec.prefix) > 0 {
+		args = append(args, "--prefix", spec.prefix+"/")
+	}
+	if len(spec.endpoint) > 0 {
+		args = append(args, "--endpoint-url", spec.endpoint)
+	}
+	if len(spec.region) > 0 {
+		args = append(args, "--region", spec.region)
+	}
+	if uid, ok := spec.options["uid"]; ok {
+		args = append(args, "--uid", uid)
+	}
+	if gid, ok := spec.options["gid"]; ok {
+		args = append(args, "--gid", gid)
+	}
+	if umask, ok := spec.options["umask"]; ok {
+		file, dir := fileModes(umask)
+		args = append(args, "--file-mode", file, "--dir-mode", dir)
+	}
+	if cache, ok := spec.options[cacheOption]; ok {
+		args = append(args, "--cache", cache)
+	}
+	if hasFlag(spec.options, "ro") {
+		args = append(args, "--read-only")
+	} else {
+		args = append(args, "--allow-delete", "--allow-overwrite")
+	}
+	if hasFlag(spec.options, "allow_other") {
+		args = append(args, "--allow-other")
+	}
+	return exec.Command(binary, args...)
+}
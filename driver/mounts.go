@@ -0,0 +1,438 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const mountInfoFile = "/proc/self/mountinfo"
+
+// mountInfo is the state of a volume mounted on this host
+type mountInfo struct {
+	Volume     string    `json:"volume"`
+	Mountpoint string    `json:"mountpoint"`
+	IDs        []string  `json:"ids"`
+	PID        int       `json:"pid"`
+	Started    time.Time `json:"started"`
+	Rotate     bool      `json:"rotate,omitempty"`
+	Backend    string    `json:"backend,omitempty"`
+	Restarts   int       `json:"restarts,omitempty"`
+	// output are the last lines of the mount process
+	output *mountOutput
+	// starting is closed once the backend being started is ready or failed
+	starting chan struct{}
+	// mounting tells that the volume is mounted for the first time
+	mounting bool
+}
+
+// hasID checks if a docker mount id uses the mount
+func (m *mountInfo) hasID(id string) bool {
+	for _, v := range m.IDs {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// addID adds a docker mount id to the mount (once)
+func (m *mountInfo) addID(id string) bool {
+	if m.hasID(id) {
+		return false
+	}
+	m.IDs = append(m.IDs, id)
+	return true
+}
+
+// removeID removes a docker mount id from the mount
+func (m *mountInfo) removeID(id string) bool {
+	for i, v := range m.IDs {
+		if v == id {
+			m.IDs = append(m.IDs[:i], m.IDs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// mountEntry is a line of the mountinfo file
+type mountEntry struct {
+	Mountpoint string
+	FSType     string
+	Source     string
+}
+
+// unescapeMountInfo decodes the octal escapes (\040) of the mountinfo fields
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	buf := bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				buf.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// parseMountInfo gets the mounts of this process mount namespace
+func parseMountInfo() ([]*mountEntry, error) {
+	f, err := os.Open(mountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make([]*mountEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		entries = append(entries, &mountEntry{
+			Mountpoint: unescapeMountInfo(fields[4]),
+			FSType:     fields[sep+1],
+			Source:     unescapeMountInfo(fields[sep+2]),
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// isMounted checks if a fuse filesystem is mounted on a mountpoint
+func isMounted(mountpoint string) bool {
+	entries, err := parseMountInfo()
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.Mountpoint == mountpoint && strings.HasPrefix(e.FSType, "fuse") {
+			return true
+		}
+	}
+	return false
+}
+
+// unmount unmounts a mountpoint
+func unmount(mountpoint string) error {
+	cmd := exec.Command("umount", mountpoint)
+	log.WithField("command", "driver").WithField("method", "unmount").Infof("cmd: %s", strings.Join(cmd.Args, " "))
+	_, err := cmd.Output()
+	if err != nil {
+		switch e := err.(type) {
+		case *exec.ExitError:
+			if len(e.Stderr) > 0 {
+				message := strings.ReplaceAll(string(e.Stderr), "\n", "\\n")
+				log.WithField("command", "driver").WithField("method", "umount").Errorf("error executing the umount command: '%s'", message)
+				return fmt.Errorf("error executing the umount command: '%s'", message)
+			}
+			log.WithField("command", "driver").WithField("method", "umount").Errorf("error executing the umount command: %s", err)
+			return fmt.Errorf("error executing the umount command: %s", err)
+		default:
+			log.WithField("command", "driver").WithField("method", "umount").Errorf("error executing the umount command: %s", err)
+			return fmt.Errorf("error executing the umount command: %s", err)
+		}
+	}
+	return nil
+}
+
+// lazyUnmount detaches a mountpoint even if it is busy or dead
+func lazyUnmount(mountpoint string) error {
+	out, err := exec.Command("umount", "-l", mountpoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// processAlive checks if a process exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+// findMountProcess finds the backend process serving a mountpoint
+func findMountProcess(mountpoint string) int {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if !isMountBinary(filepath.Base(args[0])) {
+			continue
+		}
+		for _, arg := range args[1:] {
+			if strings.TrimRight(arg, "/") == mountpoint {
+				return pid
+			}
+		}
+	}
+	return 0
+}
+
+// saveMounts writes the mount state file (mountsLock must be held)
+func (d *S3fsDriver) saveMounts() {
+	if len(d.StateFile) == 0 {
+		return
+	}
+	// the mounts in progress are saved once ready
+	mounts := make(map[string]*mountInfo)
+	for name, m := range d.mounts {
+		if !m.mounting {
+			mounts[name] = m
+		}
+	}
+	data, err := json.MarshalIndent(mounts, "", "  ")
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "state").Errorf("could not encode mount state: %s", err)
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(d.StateFile), 0700)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "state").Errorf("could not create state directory: %s", err)
+		return
+	}
+	// write and rename to never leave a partial state
+	tmp := d.StateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "state").Errorf("could not write mount state: %s", err)
+		return
+	}
+	err = os.Rename(tmp, d.StateFile)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "state").Errorf("could not write mount state: %s", err)
+	}
+}
+
+// loadMounts reads the mount state file
+func (d *S3fsDriver) loadMounts() (map[string]*mountInfo, error) {
+	mounts := make(map[string]*mountInfo)
+	if len(d.StateFile) == 0 {
+		return mounts, nil
+	}
+	data, err := ioutil.ReadFile(d.StateFile)
+	if os.IsNotExist(err) {
+		return mounts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &mounts)
+	if err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// mountedHere checks if a volume is mounted on this host
+// by this process or, for the command line, by the plugin keeping the state file
+func (d *S3fsDriver) mountedHere(volumeName string) (bool, error) {
+	d.mountsLock.Lock()
+	defer d.mountsLock.Unlock()
+	if m, ok := d.mounts[volumeName]; ok && len(m.IDs) > 0 {
+		return true, nil
+	}
+	saved, err := d.loadMounts()
+	if err != nil {
+		return false, fmt.Errorf("could not read mount state %s: %s", d.StateFile, err)
+	}
+	m, ok := saved[volumeName]
+	return ok && len(m.IDs) > 0 && isMounted(m.Mountpoint), nil
+}
+
+// mountLock gets the lock telling the other hosts that this process mounts a volume
+func mountLock(volumeName string) (string, error) {
+	owner, err := getLockOwner()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s/%s-%s", mountLocksPrefix, volumeName, owner.Hostname, owner.Nonce), nil
+}
+
+// holdMount takes the mount lock of a volume mounted by this process
+// the mount goes on without it: only the checks of the other hosts miss it
+func (d *S3fsDriver) holdMount(volumeName string) {
+	lock, err := mountLock(volumeName)
+	if err == nil {
+		err = d.locker.Lock(lock)
+	}
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "mount").Warnf("could not tell the other hosts that volume %s is mounted: %s", volumeName, err)
+	}
+}
+
+// releaseMount releases the mount lock of a volume unmounted by this process
+func (d *S3fsDriver) releaseMount(volumeName string) {
+	lock, err := mountLock(volumeName)
+	if err == nil {
+		err = d.locker.UnLock(lock)
+	}
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "unmount").Warnf("could not tell the other hosts that volume %s is unmounted: %s", volumeName, err)
+	}
+}
+
+// mountedBy gets the processes of all hosts mounting a volume from their mount locks
+func (d *S3fsDriver) mountedBy(volumeName string) ([]*LockOwner, error) {
+	locks, err := d.locker.Locks()
+	if err != nil {
+		return nil, err
+	}
+	owners := make([]*LockOwner, 0)
+	for _, l := range locks {
+		if !strings.HasPrefix(l.Object, mountLocksPrefix+volumeName+"/") {
+			continue
+		}
+		// the locks of the stopped processes expire
+		if !l.Expires.IsZero() && l.expired() {
+			continue
+		}
+		owner := l.Owner
+		owners = append(owners, &owner)
+	}
+	return owners, nil
+}
+
+// checkUnmounted fails if a volume is mounted on any host
+func (d *S3fsDriver) checkUnmounted(volumeName string) error {
+	mounted, err := d.mountedHere(volumeName)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return fmt.Errorf("volume %s is mounted on this host", volumeName)
+	}
+	owners, err := d.mountedBy(volumeName)
+	if err != nil {
+		return fmt.Errorf("could not check the mounts of volume %s: %s", volumeName, err)
+	}
+	if len(owners) > 0 {
+		hosts := make([]string, len(owners))
+		for i, o := range owners {
+			hosts[i] = o.String()
+		}
+		return fmt.Errorf("volume %s is mounted by %s", volumeName, strings.Join(hosts, ", "))
+	}
+	return nil
+}
+
+// checkUnused fails if a volume is mounted on any host or its config is locked by an operation
+func (d *S3fsDriver) checkUnused(volumeName string) error {
+	err := d.checkUnmounted(volumeName)
+	if err != nil {
+		return err
+	}
+	locks, err := d.locker.Locks(volumeObjectName(volumeName))
+	if err != nil {
+		return fmt.Errorf("could not check the lock of volume %s: %s", volumeName, err)
+	}
+	for _, l := range locks {
+		if l.Expires.IsZero() || !l.expired() {
+			return fmt.Errorf("volume %s is locked by %s", volumeName, l.Owner.String())
+		}
+	}
+	return nil
+}
+
+// reconcileMounts re-adopts the live mounts of the state file and cleans up the dead ones
+func (d *S3fsDriver) reconcileMounts() error {
+	d.mountsLock.Lock()
+	defer d.mountsLock.Unlock()
+	saved, err := d.loadMounts()
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "reconcile").Errorf("could not read mount state %s: %s", d.StateFile, err)
+		return fmt.Errorf("could not read mount state %s: %s", d.StateFile, err)
+	}
+	entries, err := parseMountInfo()
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "reconcile").Errorf("could not read %s: %s", mountInfoFile, err)
+		return fmt.Errorf("could not read %s: %s", mountInfoFile, err)
+	}
+	// fuse mounts under the mount root
+	live := make(map[string]*mountEntry)
+	for _, e := range entries {
+		if strings.HasPrefix(e.FSType, "fuse") && filepath.Dir(e.Mountpoint) == d.RootMount {
+			live[e.Mountpoint] = e
+		}
+	}
+	d.mounts = make(map[string]*mountInfo)
+	for name, m := range saved {
+		if _, ok := live[m.Mountpoint]; !ok {
+			log.WithField("command", "driver").WithField("method", "reconcile").Warnf("volume %s is not mounted anymore on %s, dropping mounts %s", name, m.Mountpoint, strings.Join(m.IDs, ","))
+			continue
+		}
+		if len(m.IDs) == 0 {
+			log.WithField("command", "driver").WithField("method", "reconcile").Warnf("volume %s is not used anymore, unmounting %s", name, m.Mountpoint)
+			continue
+		}
+		if len(m.Backend) == 0 {
+			// mounted before the backends
+			m.Backend = backendS3fs
+		}
+		if m.Backend == backendNative {
+			// the filesystem was served by the previous plugin process
+			log.WithField("command", "driver").WithField("method", "reconcile").Warnf("native filesystem of volume %s is gone, unmounting %s", name, m.Mountpoint)
+			continue
+		}
+		if !processAlive(m.PID) {
+			m.PID = findMountProcess(m.Mountpoint)
+		}
+		if m.PID == 0 {
+			// the fuse daemon is gone: the mountpoint is dead
+			log.WithField("command", "driver").WithField("method", "reconcile").Warnf("s3fs of volume %s is gone, unmounting %s", name, m.Mountpoint)
+			continue
+		}
+		log.WithField("command", "driver").WithField("method", "reconcile").Infof("re-adopted volume %s mounted on %s by s3fs[%d] for mounts %s", name, m.Mountpoint, m.PID, strings.Join(m.IDs, ","))
+		d.mounts[name] = m
+		delete(live, m.Mountpoint)
+		d.holdMount(name)
+		go d.supervise(m, watchProcess(m.PID))
+	}
+	// unmount what isn't tracked
+	for mountpoint := range live {
+		log.WithField("command", "driver").WithField("method", "reconcile").Warnf("unmounting untracked or dead mount %s", mountpoint)
+		err := lazyUnmount(mountpoint)
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "reconcile").Errorf("could not unmount %s: %s", mountpoint, err)
+		}
+	}
+	d.saveMounts()
+	return nil
+}
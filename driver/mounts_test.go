@@ -0,0 +1,105 @@
+package driver
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnescapeMountInfo(t *testing.T) {
+	tests := []struct {
+		field    string
+		expected string
+	}{
+		{"/var/lib/docker", "/var/lib/docker"},
+		{"/mnt/my\\040volume", "/mnt/my volume"},
+		{"/mnt/tab\\011and\\012newline", "/mnt/tab\tand\nnewline"},
+		{"/mnt/back\\134slash", "/mnt/back\\slash"},
+		{"bucket:/a\\040b\\040c", "bucket:/a b c"},
+		{"/mnt/not\\0octal", "/mnt/not\\0octal"},
+		{"/mnt/bad\\999", "/mnt/bad\\999"},
+		{"/mnt/end\\04", "/mnt/end\\04"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		unescaped := unescapeMountInfo(test.field)
+		if unescaped != test.expected {
+			t.Errorf("unescapeMountInfo(%q) = %q, expected %q", test.field, unescaped, test.expected)
+		}
+	}
+}
+
+func TestMountedBy(t *testing.T) {
+	stub := &s3Stub{objects: map[string][]byte{}, buckets: map[string]time.Time{}}
+	d := newConfigDriver(t, stub)
+	d.StateFile = filepath.Join(t.TempDir(), "mounts.json")
+	d.mounts = make(map[string]*mountInfo)
+	owner, err := getLockOwner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.holdMount("vol")
+	// the volumes with a common prefix are not mixed up
+	d.holdMount("vol2")
+	owners, err := d.mountedBy("vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 1 || !owners[0].same(owner) {
+		t.Errorf("unexpected owners of the mount locks of vol: %v", owners)
+	}
+	err = d.checkUnmounted("vol")
+	if err == nil || !strings.Contains(err.Error(), "is mounted by "+owner.Hostname) {
+		t.Errorf("unexpected error for a volume mounted by a host: %v", err)
+	}
+	d.releaseMount("vol")
+	err = d.checkUnmounted("vol")
+	if err != nil {
+		t.Errorf("unexpected error for an unmounted volume: %s", err)
+	}
+	// the volumes mounted before the mount locks
+	d.mounts["vol"] = &mountInfo{Volume: "vol", IDs: []string{"id"}}
+	err = d.checkUnmounted("vol")
+	if err == nil || !strings.Contains(err.Error(), "is mounted on this host") {
+		t.Errorf("unexpected error for a volume mounted on this host: %v", err)
+	}
+}
+
+func TestRemoveVolumeInUse(t *testing.T) {
+	stub := &s3Stub{objects: map[string][]byte{}, buckets: map[string]time.Time{}}
+	d := newConfigDriver(t, stub)
+	d.StateFile = filepath.Join(t.TempDir(), "mounts.json")
+	d.mounts = make(map[string]*mountInfo)
+	err := d.writeVolumeConfig(&VolConfig{Name: "vol", Bucket: "vol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.holdMount("vol")
+	err = d.RemoveVolume("vol", false)
+	if err == nil || !strings.Contains(err.Error(), "is mounted by") {
+		t.Errorf("unexpected error removing a mounted volume: %v", err)
+	}
+	d.releaseMount("vol")
+	// an operation on the volume holds its config lock
+	err = d.locker.Lock(volumeObjectName("vol"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.RemoveVolume("vol", false)
+	if err == nil || !strings.Contains(err.Error(), "is locked by") {
+		t.Errorf("unexpected error removing a locked volume: %v", err)
+	}
+	d.locker.UnLock(volumeObjectName("vol"))
+	if _, ok := stub.objects["s3vol/"+volumeObjectName("vol")]; !ok {
+		t.Errorf("volume in use removed")
+	}
+	// the data of the volume is not owned
+	err = d.RemoveVolume("vol", false)
+	if err != nil {
+		t.Errorf("could not remove volume: %s", err)
+	}
+	if _, ok := stub.objects["s3vol/"+volumeObjectName("vol")]; ok {
+		t.Errorf("volume not removed")
+	}
+}
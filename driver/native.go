@@ -0,0 +1,825 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// nativeAttrTTL is the default time attributes and entries are cached
+	nativeAttrTTL = time.Minute
+	// nativeBlocks is the size reported for a bucket (in 4KiB blocks)
+	nativeBlocks = 1 << 36
+)
+
+// nativeOptions are the volume options of the native backend
+var nativeOptions = map[string]int{
+	"uid":               optInt,
+	"gid":               optInt,
+	"umask":             optOctal,
+	"ro":                optFlag,
+	"allow_other":       optFlag,
+	cacheOption:         optPath,
+	"stat_cache_expire": optInt,
+}
+
+// nativeAttr are the cached attributes of a path
+type nativeAttr struct {
+	dir     bool
+	size    int64
+	mtime   time.Time
+	expires time.Time
+}
+
+// nativeFS is an in process fuse filesystem over a bucket or prefix
+// directories are key prefixes and files are written to s3 when closed
+type nativeFS struct {
+	clt      *minio.Client
+	bucket   string
+	prefix   string
+	uid      uint32
+	gid      uint32
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	readOnly bool
+	cacheDir string
+	attrTTL  time.Duration
+	lock     sync.Mutex
+	attrs    map[string]*nativeAttr
+	files    map[string]*nativeFile
+	dirs     map[string]*nativeDir
+}
+
+// newNativeFS creates the filesystem of a mount
+func newNativeFS(clt *minio.Client, spec *mountSpec) *nativeFS {
+	f := &nativeFS{
+		clt:      clt,
+		bucket:   spec.bucket,
+		readOnly: hasFlag(spec.options, "ro"),
+		cacheDir: os.TempDir(),
+		attrTTL:  nativeAttrTTL,
+		attrs:    make(map[string]*nativeAttr),
+		files:    make(map[string]*nativeFile),
+		dirs:     make(map[string]*nativeDir),
+	}
+	if len(spec.prefix) > 0 {
+		f.prefix = spec.prefix + "/"
+	}
+	if uid, err := strconv.ParseUint(spec.options["uid"], 10, 32); err == nil {
+		f.uid = uint32(uid)
+	}
+	if gid, err := strconv.ParseUint(spec.options["gid"], 10, 32); err == nil {
+		f.gid = uint32(gid)
+	}
+	file, dir := fileModes(spec.options["umask"])
+	if mode, err := strconv.ParseUint(file, 8, 32); err == nil {
+		f.fileMode = os.FileMode(mode)
+	}
+	if mode, err := strconv.ParseUint(dir, 8, 32); err == nil {
+		f.dirMode = os.FileMode(mode)
+	}
+	if cache, ok := spec.options[cacheOption]; ok {
+		f.cacheDir = cache
+	}
+	if ttl, err := strconv.Atoi(spec.options["stat_cache_expire"]); err == nil {
+		f.attrTTL = time.Duration(ttl) * time.Second
+	}
+	return f
+}
+
+// mountNative mounts a volume with the in process filesystem
+func (d *S3fsDriver) mountNative(volConfig *VolConfig, spec *mountSpec) error {
+	clt, err := d.volumeClient(volConfig)
+	if err != nil {
+		return fmt.Errorf("could not get s3 client: %s", err)
+	}
+	options := []fuse.MountOption{fuse.FSName(volConfig.Source()), fuse.Subtype("s3vol")}
+	if hasFlag(spec.options, "allow_other") {
+		options = append(options, fuse.AllowOther())
+	}
+	if hasFlag(spec.options, "ro") {
+		options = append(options, fuse.ReadOnly())
+	}
+	conn, err := fuse.Mount(spec.mountpoint, options...)
+	if err != nil {
+		return err
+	}
+	<-conn.Ready
+	if conn.MountError != nil {
+		conn.Close()
+		return conn.MountError
+	}
+	go func() {
+		// serves until the mountpoint is unmounted
+		err := fs.Serve(conn, newNativeFS(clt, spec))
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "native").Errorf("filesystem of volume %s failed: %s", volConfig.Name, err)
+		}
+		conn.Close()
+		log.WithField("command", "driver").WithField("method", "native").Infof("filesystem of volume %s stopped", volConfig.Name)
+	}()
+	return nil
+}
+
+// nativePath joins a name to a directory path
+func nativePath(dir string, name string) string {
+	if len(dir) == 0 {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// key gets the object key of a file
+func (f *nativeFS) key(path string) string {
+	return f.prefix + path
+}
+
+// dirKey gets the key prefix of a directory
+func (f *nativeFS) dirKey(path string) string {
+	if len(path) == 0 {
+		return f.prefix
+	}
+	return f.prefix + path + "/"
+}
+
+// cached gets the attributes of a path if they didn't expire
+func (f *nativeFS) cached(path string) *nativeAttr {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	a, ok := f.attrs[path]
+	if !ok || time.Now().After(a.expires) {
+		return nil
+	}
+	return a
+}
+
+// cache keeps the attributes of a path
+func (f *nativeFS) cache(path string, a *nativeAttr) {
+	a.expires = time.Now().Add(f.attrTTL)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.attrs[path] = a
+}
+
+// forget drops the cached attributes of a path and its children
+func (f *nativeFS) forget(path string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for p := range f.attrs {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			delete(f.attrs, p)
+		}
+	}
+}
+
+// stat gets the attributes of a path
+func (f *nativeFS) stat(path string) (*nativeAttr, error) {
+	if a := f.cached(path); a != nil {
+		return a, nil
+	}
+	info, err := f.clt.StatObject(f.bucket, f.key(path), minio.StatObjectOptions{})
+	if err == nil {
+		a := &nativeAttr{size: info.Size, mtime: info.LastModified}
+		f.cache(path, a)
+		return a, nil
+	}
+	if code := minio.ToErrorResponse(err).Code; code != "NoSuchKey" && code != "NotFound" {
+		return nil, err
+	}
+	// a directory is any prefix with objects
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range f.clt.ListObjectsV2(f.bucket, f.dirKey(path), false, doneCh) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		a := &nativeAttr{dir: true}
+		f.cache(path, a)
+		return a, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// node gets the node of a path
+func (f *nativeFS) node(path string, a *nativeAttr) fs.Node {
+	if a.dir {
+		return f.dir(path)
+	}
+	return f.file(path)
+}
+
+// dir gets the node of a directory, the same while the kernel knows it
+func (f *nativeFS) dir(path string) *nativeDir {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if d, ok := f.dirs[path]; ok {
+		return d
+	}
+	d := &nativeDir{fs: f, path: path}
+	f.dirs[path] = d
+	return d
+}
+
+// file gets the node of a file, the same while the kernel knows it
+func (f *nativeFS) file(path string) *nativeFile {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if n, ok := f.files[path]; ok {
+		return n
+	}
+	n := &nativeFile{fs: f, path: path}
+	f.files[path] = n
+	return n
+}
+
+// move moves the nodes of a path (a file or a directory) once copied
+// the pending writes of the files are sent before the copy and no write happens during it
+func (f *nativeFS) move(from string, to string, copy func() error) error {
+	f.lock.Lock()
+	paths := make([]string, 0)
+	for path := range f.files {
+		if path == from || strings.HasPrefix(path, from+"/") {
+			paths = append(paths, path)
+		}
+	}
+	nodes := make([]*nativeFile, 0, len(paths))
+	// always lock the files in the same order
+	sort.Strings(paths)
+	for _, path := range paths {
+		nodes = append(nodes, f.files[path])
+	}
+	f.lock.Unlock()
+	for i, n := range nodes {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		if n.path != paths[i] {
+			// moved in the mean time
+			nodes[i] = nil
+			continue
+		}
+		if n.writer != nil {
+			err := n.writer.upload()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := copy()
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, n := range nodes {
+		if n == nil {
+			continue
+		}
+		n.path = to + strings.TrimPrefix(paths[i], from)
+		if f.files[paths[i]] == n {
+			delete(f.files, paths[i])
+		}
+		f.files[n.path] = n
+	}
+	// the directories the kernel knows under the moved one
+	dirs := make(map[string]*nativeDir)
+	for path, d := range f.dirs {
+		if path == from || strings.HasPrefix(path, from+"/") {
+			dirs[path] = d
+			delete(f.dirs, path)
+		}
+	}
+	for path, d := range dirs {
+		d.lock.Lock()
+		d.path = to + strings.TrimPrefix(path, from)
+		d.lock.Unlock()
+		f.dirs[to+strings.TrimPrefix(path, from)] = d
+	}
+	return nil
+}
+
+// check fails the changes of a read only filesystem
+func (f *nativeFS) check() error {
+	if f.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return nil
+}
+
+// failed logs a failed s3 operation and gets the fuse error
+func (f *nativeFS) failed(operation string, path string, err error) error {
+	if err == fuse.ENOENT {
+		return err
+	}
+	log.WithField("command", "driver").WithField("method", "native").Errorf("could not %s %s/%s: %s", operation, f.bucket, f.key(path), err)
+	return fuse.EIO
+}
+
+//Root gets the root directory of the filesystem
+func (f *nativeFS) Root() (fs.Node, error) {
+	return f.dir(""), nil
+}
+
+//Statfs reports the filesystem usage (buckets have no size limit)
+func (f *nativeFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	resp.Blocks = nativeBlocks
+	resp.Bfree = nativeBlocks
+	resp.Bavail = nativeBlocks
+	resp.Files = nativeBlocks
+	resp.Ffree = nativeBlocks
+	resp.Bsize = 4096
+	resp.Frsize = 4096
+	resp.Namelen = 1024
+	return nil
+}
+
+// nativeDir is a directory of the native filesystem
+type nativeDir struct {
+	fs   *nativeFS
+	lock sync.Mutex
+	path string
+}
+
+// getPath gets the current path of a directory
+func (d *nativeDir) getPath() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.path
+}
+
+//Forget drops the node once the kernel doesn't know it anymore
+func (d *nativeDir) Forget() {
+	path := d.getPath()
+	d.fs.lock.Lock()
+	defer d.fs.lock.Unlock()
+	if d.fs.dirs[path] == d {
+		delete(d.fs.dirs, path)
+	}
+}
+
+//Attr gets the attributes of the directory
+func (d *nativeDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | d.fs.dirMode
+	a.Uid = d.fs.uid
+	a.Gid = d.fs.gid
+	a.Valid = d.fs.attrTTL
+	return nil
+}
+
+//Lookup finds a file or directory in the directory
+func (d *nativeDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	path := nativePath(d.getPath(), req.Name)
+	a, err := d.fs.stat(path)
+	if err != nil {
+		return nil, d.fs.failed("stat", path, err)
+	}
+	resp.EntryValid = d.fs.attrTTL
+	return d.fs.node(path, a), nil
+}
+
+//ReadDirAll lists the directory
+func (d *nativeDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dir := d.getPath()
+	prefix := d.fs.dirKey(dir)
+	entries := make([]fuse.Dirent, 0)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range d.fs.clt.ListObjectsV2(d.fs.bucket, prefix, false, doneCh) {
+		if object.Err != nil {
+			return nil, d.fs.failed("list", dir, object.Err)
+		}
+		name := strings.TrimPrefix(object.Key, prefix)
+		if len(name) == 0 {
+			// the directory object
+			continue
+		}
+		if strings.HasSuffix(name, "/") {
+			name = strings.TrimSuffix(name, "/")
+			d.fs.cache(nativePath(dir, name), &nativeAttr{dir: true})
+			entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+			continue
+		}
+		d.fs.cache(nativePath(dir, name), &nativeAttr{size: object.Size, mtime: object.LastModified})
+		entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+//Mkdir creates a directory object
+func (d *nativeDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if err := d.fs.check(); err != nil {
+		return nil, err
+	}
+	path := nativePath(d.getPath(), req.Name)
+	_, err := d.fs.clt.PutObject(d.fs.bucket, d.fs.dirKey(path), bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	if err != nil {
+		return nil, d.fs.failed("create directory", path, err)
+	}
+	d.fs.cache(path, &nativeAttr{dir: true})
+	return d.fs.dir(path), nil
+}
+
+//Create creates a file, written to s3 when closed
+func (d *nativeDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if err := d.fs.check(); err != nil {
+		return nil, nil, err
+	}
+	path := nativePath(d.getPath(), req.Name)
+	file := d.fs.file(path)
+	h, err := file.openWriter(true)
+	if err != nil {
+		return nil, nil, d.fs.failed("create", path, err)
+	}
+	d.fs.cache(path, &nativeAttr{mtime: time.Now()})
+	return file, h, nil
+}
+
+//Remove removes a file or an empty directory
+func (d *nativeDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if err := d.fs.check(); err != nil {
+		return err
+	}
+	path := nativePath(d.getPath(), req.Name)
+	key := d.fs.key(path)
+	if req.Dir {
+		key = d.fs.dirKey(path)
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		for object := range d.fs.clt.ListObjectsV2(d.fs.bucket, key, false, doneCh) {
+			if object.Err != nil {
+				return d.fs.failed("list", path, object.Err)
+			}
+			if object.Key != key {
+				return fuse.Errno(syscall.ENOTEMPTY)
+			}
+		}
+	}
+	err := d.fs.clt.RemoveObject(d.fs.bucket, key)
+	if err != nil {
+		return d.fs.failed("remove", path, err)
+	}
+	d.fs.forget(path)
+	return nil
+}
+
+//Rename copies a file or the files of a directory then removes the originals
+func (d *nativeDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if err := d.fs.check(); err != nil {
+		return err
+	}
+	target, ok := newDir.(*nativeDir)
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	from := nativePath(d.getPath(), req.OldName)
+	to := nativePath(target.getPath(), req.NewName)
+	a, err := d.fs.stat(from)
+	if err != nil {
+		return d.fs.failed("stat", from, err)
+	}
+	if !a.dir {
+		// the open file is written under its new name once copied
+		err = d.fs.move(from, to, func() error {
+			// the size changes with the pending writes
+			a, err := d.fs.stat(from)
+			if err != nil {
+				return err
+			}
+			return copyObject(d.fs.clt, d.fs.bucket, d.fs.key(from), a.size, d.fs.bucket, d.fs.key(to))
+		})
+		if err == nil {
+			err = d.fs.clt.RemoveObject(d.fs.bucket, d.fs.key(from))
+		}
+		d.fs.forget(from)
+		d.fs.forget(to)
+		if err != nil {
+			return d.fs.failed("rename", from, err)
+		}
+		return nil
+	}
+	src, dst := d.fs.dirKey(from), d.fs.dirKey(to)
+	moved := make([]string, 0)
+	err = d.fs.move(from, to, func() error {
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		for object := range d.fs.clt.ListObjectsV2(d.fs.bucket, src, true, doneCh) {
+			if object.Err != nil {
+				return object.Err
+			}
+			err := copyObject(d.fs.clt, d.fs.bucket, object.Key, object.Size, d.fs.bucket, dst+strings.TrimPrefix(object.Key, src))
+			if err != nil {
+				return err
+			}
+			moved = append(moved, object.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return d.fs.failed("rename", from, err)
+	}
+	// the originals are removed once everything is copied
+	for _, key := range moved {
+		err = d.fs.clt.RemoveObject(d.fs.bucket, key)
+		if err != nil {
+			return d.fs.failed("rename", from, err)
+		}
+	}
+	d.fs.forget(from)
+	d.fs.forget(to)
+	return nil
+}
+
+// nativeFile is a file of the native filesystem
+// the opened for writing handles share a local copy of the file
+type nativeFile struct {
+	fs     *nativeFS
+	lock   sync.Mutex
+	path   string
+	writer *nativeHandle
+}
+
+// getPath gets the current path of a file
+func (n *nativeFile) getPath() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.path
+}
+
+//Attr gets the attributes of the file
+func (n *nativeFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = n.fs.fileMode
+	a.Uid = n.fs.uid
+	a.Gid = n.fs.gid
+	a.Valid = n.fs.attrTTL
+	n.lock.Lock()
+	path := n.path
+	if n.writer != nil {
+		// the local copy is the current content
+		info, err := n.writer.tmp.Stat()
+		n.lock.Unlock()
+		if err != nil {
+			return n.fs.failed("stat", path, err)
+		}
+		a.Size = uint64(info.Size())
+		a.Mtime = info.ModTime()
+		a.Blocks = (a.Size + 511) / 512
+		return nil
+	}
+	n.lock.Unlock()
+	attr, err := n.fs.stat(path)
+	if err != nil {
+		return n.fs.failed("stat", path, err)
+	}
+	a.Size = uint64(attr.size)
+	a.Mtime = attr.mtime
+	a.Blocks = (a.Size + 511) / 512
+	return nil
+}
+
+//Open opens the file for reading from s3 or writing to a local copy
+func (n *nativeFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if req.Flags.IsReadOnly() {
+		return &nativeHandle{file: n}, nil
+	}
+	if err := n.fs.check(); err != nil {
+		return nil, err
+	}
+	h, err := n.openWriter(req.Flags&fuse.OpenTruncate != 0)
+	if err != nil {
+		return nil, n.fs.failed("open", n.getPath(), err)
+	}
+	return h, nil
+}
+
+//Setattr changes the size of the file (the other attributes are fixed)
+func (n *nativeFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		if err := n.fs.check(); err != nil {
+			return err
+		}
+		h, err := n.openWriter(req.Size == 0)
+		if err != nil {
+			return n.fs.failed("truncate", n.getPath(), err)
+		}
+		n.lock.Lock()
+		err = h.tmp.Truncate(int64(req.Size))
+		h.dirty = true
+		n.lock.Unlock()
+		if err != nil {
+			h.release()
+			return n.fs.failed("truncate", n.getPath(), err)
+		}
+		err = h.release()
+		if err != nil {
+			return n.fs.failed("truncate", n.getPath(), err)
+		}
+	}
+	return n.Attr(ctx, &resp.Attr)
+}
+
+//Fsync writes the file to s3
+func (n *nativeFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.writer == nil {
+		return nil
+	}
+	err := n.writer.upload()
+	if err != nil {
+		return n.fs.failed("write", n.path, err)
+	}
+	return nil
+}
+
+//Forget drops the node once the kernel doesn't know it anymore
+func (n *nativeFile) Forget() {
+	path := n.getPath()
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	if n.fs.files[path] == n {
+		delete(n.fs.files, path)
+	}
+}
+
+// openWriter gets the writer of the file, with a local copy of the object unless truncated
+func (n *nativeFile) openWriter(truncate bool) (*nativeHandle, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.writer != nil {
+		n.writer.refs++
+		if truncate {
+			n.writer.dirty = true
+			return n.writer, n.writer.tmp.Truncate(0)
+		}
+		return n.writer, nil
+	}
+	tmp, err := ioutil.TempFile(n.fs.cacheDir, "s3vol-")
+	if err != nil {
+		return nil, err
+	}
+	h := &nativeHandle{file: n, tmp: tmp, refs: 1, dirty: truncate}
+	if !truncate {
+		err = h.download()
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	n.writer = h
+	return h, nil
+}
+
+// nativeHandle is an open file: reads go to s3 and writes to a local copy
+type nativeHandle struct {
+	file *nativeFile
+	// lock protects the object of a read handle
+	lock   sync.Mutex
+	object *minio.Object
+	tmp    *os.File
+	dirty  bool
+	refs   int
+}
+
+// download copies the object to the local copy (file lock must be held)
+func (h *nativeHandle) download() error {
+	obj, err := h.file.fs.clt.GetObject(h.file.fs.bucket, h.file.fs.key(h.file.path), minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	_, err = io.Copy(h.tmp, obj)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return err
+	}
+	return nil
+}
+
+// upload writes the local copy to s3 (file lock must be held)
+func (h *nativeHandle) upload() error {
+	if !h.dirty {
+		return nil
+	}
+	info, err := h.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	path := h.file.path
+	err = retry(func() error {
+		_, err := h.file.fs.clt.PutObject(h.file.fs.bucket, h.file.fs.key(path), io.NewSectionReader(h.tmp, 0, info.Size()), info.Size(), minio.PutObjectOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	h.dirty = false
+	h.file.fs.cache(path, &nativeAttr{size: info.Size(), mtime: time.Now()})
+	return nil
+}
+
+// release closes a writer, written to s3 by its last user
+func (h *nativeHandle) release() error {
+	h.file.lock.Lock()
+	defer h.file.lock.Unlock()
+	h.refs--
+	if h.refs > 0 {
+		return nil
+	}
+	err := h.upload()
+	h.tmp.Close()
+	os.Remove(h.tmp.Name())
+	h.file.writer = nil
+	return err
+}
+
+//Read reads the local copy of the file being written or a range of the object
+func (h *nativeHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	var n int
+	var err error
+	h.file.lock.Lock()
+	path := h.file.path
+	if h.file.writer != nil {
+		n, err = h.file.writer.tmp.ReadAt(buf, req.Offset)
+		h.file.lock.Unlock()
+	} else {
+		h.file.lock.Unlock()
+		h.lock.Lock()
+		if h.object == nil {
+			h.object, err = h.file.fs.clt.GetObject(h.file.fs.bucket, h.file.fs.key(path), minio.GetObjectOptions{})
+			if err != nil {
+				h.lock.Unlock()
+				return h.file.fs.failed("read", path, err)
+			}
+		}
+		object := h.object
+		h.lock.Unlock()
+		n, err = object.ReadAt(buf, req.Offset)
+	}
+	if err != nil && err != io.EOF {
+		return h.file.fs.failed("read", path, err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+//Write writes to the local copy
+func (h *nativeHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if h.tmp == nil {
+		return fuse.Errno(syscall.EBADF)
+	}
+	h.file.lock.Lock()
+	defer h.file.lock.Unlock()
+	n, err := h.tmp.WriteAt(req.Data, req.Offset)
+	if err != nil {
+		return h.file.fs.failed("write", h.file.path, err)
+	}
+	h.dirty = true
+	resp.Size = n
+	return nil
+}
+
+//Flush writes the local copy to s3 when the file is closed
+func (h *nativeHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	if h.tmp == nil {
+		return nil
+	}
+	h.file.lock.Lock()
+	defer h.file.lock.Unlock()
+	err := h.upload()
+	if err != nil {
+		return h.file.fs.failed("write", h.file.path, err)
+	}
+	return nil
+}
+
+//Release closes the handle
+func (h *nativeHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if h.tmp == nil {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if h.object != nil {
+			h.object.Close()
+		}
+		return nil
+	}
+	err := h.release()
+	if err != nil {
+		return h.file.fs.failed("write", h.file.getPath(), err)
+	}
+	return nil
+}
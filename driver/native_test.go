@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// lookupDir looks up a directory node
+func lookupDir(t *testing.T, d *nativeDir, name string) *nativeDir {
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: name}, &fuse.LookupResponse{})
+	if err != nil {
+		t.Fatalf("could not look up %s in '%s': %s", name, d.getPath(), err)
+	}
+	dir, ok := node.(*nativeDir)
+	if !ok {
+		t.Fatalf("%s in '%s' is not a directory", name, d.getPath())
+	}
+	return dir
+}
+
+func TestNativeRenameLookedUpDir(t *testing.T) {
+	stub := &s3Stub{
+		objects: map[string][]byte{
+			"vol/a/b/c.txt": []byte("data"),
+			"vol/a/d.txt":   []byte("other"),
+			"vol/e.txt":     []byte("kept"),
+		},
+		buckets: map[string]time.Time{},
+	}
+	d := newConfigDriver(t, stub)
+	f := newNativeFS(d.s3client, &mountSpec{bucket: "vol", options: map[string]string{}})
+	node, err := f.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := node.(*nativeDir)
+	a := lookupDir(t, root, "a")
+	b := lookupDir(t, a, "b")
+	if lookupDir(t, root, "a") != a {
+		t.Errorf("directory node not kept while the kernel knows it")
+	}
+	err = root.Rename(context.Background(), &fuse.RenameRequest{OldName: "a", NewName: "z"}, root)
+	if err != nil {
+		t.Fatalf("could not rename: %s", err)
+	}
+	if a.getPath() != "z" || b.getPath() != "z/b" {
+		t.Errorf("looked up directories not moved: '%s', '%s'", a.getPath(), b.getPath())
+	}
+	for _, key := range []string{"vol/a/b/c.txt", "vol/a/d.txt"} {
+		if _, ok := stub.objects[key]; ok {
+			t.Errorf("%s not removed", key)
+		}
+	}
+	if string(stub.objects["vol/z/b/c.txt"]) != "data" || string(stub.objects["vol/z/d.txt"]) != "other" || string(stub.objects["vol/e.txt"]) != "kept" {
+		t.Errorf("unexpected objects after rename: %v", stub.objects)
+	}
+	// the nodes held by the kernel work on the new path
+	entries, err := b.ReadDirAll(context.Background())
+	if err != nil {
+		t.Fatalf("could not list the moved directory: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "c.txt" {
+		t.Errorf("unexpected entries of the moved directory: %v", entries)
+	}
+	node, err = b.Lookup(context.Background(), &fuse.LookupRequest{Name: "c.txt"}, &fuse.LookupResponse{})
+	if err != nil {
+		t.Fatalf("could not look up a file of the moved directory: %s", err)
+	}
+	if file := node.(*nativeFile); file.getPath() != "z/b/c.txt" {
+		t.Errorf("unexpected path of a file of the moved directory: %s", file.getPath())
+	}
+	if lookupDir(t, root, "z") != a {
+		t.Errorf("moved directory node not found under its new path")
+	}
+}
@@ -0,0 +1,217 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// kinds of values of s3fs options
+const (
+	optFlag = iota
+	optInt
+	optOctal
+	optString
+	optPath
+	optLevel
+	optSSE
+)
+
+// s3fsOptions are the s3fs and fuse options a volume can set
+var s3fsOptions = map[string]int{
+	// fuse
+	"allow_other":         optFlag,
+	"allow_root":          optFlag,
+	"default_permissions": optFlag,
+	"nonempty":            optFlag,
+	"ro":                  optFlag,
+	"rw":                  optFlag,
+	"noatime":             optFlag,
+	"kernel_cache":        optFlag,
+	"auto_cache":          optFlag,
+	"big_writes":          optFlag,
+	"max_write":           optInt,
+	"max_read":            optInt,
+	"max_readahead":       optInt,
+	"uid":                 optInt,
+	"gid":                 optInt,
+	"umask":               optOctal,
+	// common to all the backends (use_cache)
+	cacheOption: optPath,
+	// s3fs
+	"mp_umask":                   optOctal,
+	"use_cache":                  optPath,
+	"tmpdir":                     optPath,
+	"del_cache":                  optFlag,
+	"check_cache_dir_exist":      optFlag,
+	"ensure_diskfree":            optInt,
+	"storage_class":              optString,
+	"use_rrs":                    optFlag,
+	"use_sse":                    optSSE,
+	"load_sse_c":                 optPath,
+	"default_acl":                optString,
+	"retries":                    optInt,
+	"connect_timeout":            optInt,
+	"readwrite_timeout":          optInt,
+	"list_object_max_keys":       optInt,
+	"max_stat_cache_size":        optInt,
+	"stat_cache_expire":          optInt,
+	"stat_cache_interval_expire": optInt,
+	"enable_noobj_cache":         optFlag,
+	"no_check_certificate":       optFlag,
+	"ssl_verify_hostname":        optInt,
+	"nodnscache":                 optFlag,
+	"nosscache":                  optFlag,
+	"multireq_max":               optInt,
+	"parallel_count":             optInt,
+	"multipart_size":             optInt,
+	"multipart_copy_size":        optInt,
+	"singlepart_copy_limit":      optInt,
+	"max_dirty_data":             optInt,
+	"nomultipart":                optFlag,
+	"enable_content_md5":         optFlag,
+	"use_xattr":                  optFlag,
+	"noxmlns":                    optFlag,
+	"nomixupload":                optFlag,
+	"nocopyapi":                  optFlag,
+	"norenameapi":                optFlag,
+	"use_path_request_style":     optFlag,
+	"listobjectsv2":              optFlag,
+	"notsup_compat_dir":          optFlag,
+	"complement_stat":            optFlag,
+	"compat_dir":                 optFlag,
+	"public_bucket":              optInt,
+	"requester_pays":             optFlag,
+	"sigv2":                      optFlag,
+	"sigv4":                      optFlag,
+	"dbglevel":                   optLevel,
+	"curldbg":                    optFlag,
+	"no_time_stamp_msg":          optFlag,
+	"instance_name":              optString,
+}
+
+var (
+	// optionValue are the characters allowed in option values (no option separator or shell characters)
+	optionValue = regexp.MustCompile(`^[a-zA-Z0-9_./:@+-]*$`)
+	// volumeName is the format of docker volume names
+	volumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+)
+
+// validateOption checks a volume option against the options of its backend
+func (d *S3fsDriver) validateOption(allowed map[string]int, key string, value string) error {
+	kind, ok := allowed[key]
+	if !ok {
+		return fmt.Errorf("option '%s' is not allowed", key)
+	}
+	if !optionValue.MatchString(value) {
+		return fmt.Errorf("invalid value for option '%s'", key)
+	}
+	switch kind {
+	case optFlag:
+		if len(value) > 0 && value != "true" && value != "false" {
+			return fmt.Errorf("option '%s' takes no value", key)
+		}
+	case optInt:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("option '%s' must be a number", key)
+		}
+	case optOctal:
+		if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+			return fmt.Errorf("option '%s' must be an octal mode", key)
+		}
+	case optString:
+		if len(value) == 0 {
+			return fmt.Errorf("option '%s' needs a value", key)
+		}
+	case optLevel:
+		for _, level := range dbgLevels {
+			if value == level {
+				return nil
+			}
+		}
+		return fmt.Errorf("option '%s' must be one of %s", key, strings.Join(dbgLevels, ", "))
+	case optPath:
+		return d.validatePath(key, value)
+	case optSSE:
+		return d.validateSSE(key, value)
+	}
+	return nil
+}
+
+// validatePath checks that a path option is in the allowed paths
+func (d *S3fsDriver) validatePath(key string, value string) error {
+	if !filepath.IsAbs(value) {
+		return fmt.Errorf("option '%s' must be an absolute path", key)
+	}
+	path := filepath.Clean(value)
+	for _, root := range d.AllowedPaths {
+		if path == root || strings.HasPrefix(path, strings.TrimRight(root, "/")+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("option '%s' must be in %s", key, strings.Join(d.AllowedPaths, ", "))
+}
+
+// validateSSE checks the s3fs server side encryption option
+// the custom keys file (custom:<path>) must be in the allowed paths like load_sse_c
+func (d *S3fsDriver) validateSSE(key string, value string) error {
+	kind := strings.SplitN(value, ":", 2)
+	switch {
+	case len(kind) == 1 && (value == "1" || value == "sse" || value == "sses3" || value == "kmsid" || value == "k"):
+		return nil
+	case len(kind) == 2 && (kind[0] == "kmsid" || kind[0] == "k") && len(kind[1]) > 0:
+		return nil
+	case len(kind) == 2 && (kind[0] == "custom" || kind[0] == "c"):
+		return d.validatePath(key, kind[1])
+	}
+	return fmt.Errorf("option '%s' must be 1, kmsid, kmsid:<id> or custom:<path>", key)
+}
+
+// validateOptions checks the options of a volume for its backend
+func (d *S3fsDriver) validateOptions(backend string, options map[string]string) error {
+	if err := checkBackend(backend); err != nil {
+		return err
+	}
+	allowed := backendOptions(backend)
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		err := d.validateOption(allowed, k, options[k])
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "validate").Errorf("invalid options: %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// validateVolumeName checks that a volume name can be used in paths and object names
+func validateVolumeName(name string) error {
+	if !volumeName.MatchString(name) {
+		return fmt.Errorf("invalid volume name '%s'", name)
+	}
+	return nil
+}
+
+// parsePaths parses a comma separated list of absolute paths
+func parsePaths(paths string) ([]string, error) {
+	parsed := make([]string, 0)
+	for _, p := range strings.Split(paths, ",") {
+		if len(p) == 0 {
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("path '%s' is not absolute", p)
+		}
+		parsed = append(parsed, filepath.Clean(p))
+	}
+	return parsed, nil
+}
@@ -0,0 +1,65 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateOption(t *testing.T) {
+	d := &S3fsDriver{AllowedPaths: []string{"/tmp", "/var/cache/s3vol/"}}
+	tests := []struct {
+		key   string
+		value string
+		err   string
+	}{
+		{"allow_other", "", ""},
+		{"allow_other", "true", ""},
+		{"allow_other", "false", ""},
+		{"allow_other", "yes", "takes no value"},
+		{"passwd_file", "/tmp/passwd", "not allowed"},
+		{"url", "http://localhost:9000", "not allowed"},
+		{"unknown", "", "not allowed"},
+		{"uid", "1000", ""},
+		{"uid", "-1", ""},
+		{"uid", "root", "must be a number"},
+		{"mp_umask", "0022", ""},
+		{"mp_umask", "0089", "must be an octal mode"},
+		{"storage_class", "STANDARD_IA", ""},
+		{"storage_class", "", "needs a value"},
+		{"storage_class", "a,b", "invalid value"},
+		{"storage_class", "a;reboot", "invalid value"},
+		{"storage_class", "$(id)", "invalid value"},
+		{"use_sse", "1", ""},
+		{"use_sse", "kmsid", ""},
+		{"use_sse", "kmsid:arn:aws:kms:eu-west-1:123456789012:key/1234abcd", ""},
+		{"use_sse", "k:1234abcd", ""},
+		{"use_sse", "kmsid:", "must be 1, kmsid"},
+		{"use_sse", "custom:/tmp/sse.keys", ""},
+		{"use_sse", "c:/tmp/sse.keys", ""},
+		{"use_sse", "custom:/etc/shadow", "must be in"},
+		{"use_sse", "c:/tmp/../etc/shadow", "must be in"},
+		{"use_sse", "custom:sse.keys", "must be an absolute path"},
+		{"use_sse", "/etc/shadow", "must be 1, kmsid"},
+		{"use_sse", "", "must be 1, kmsid"},
+		{"load_sse_c", "/etc/shadow", "must be in"},
+		{"dbglevel", "info", ""},
+		{"dbglevel", "trace", "must be one of"},
+		{"use_cache", "/tmp", ""},
+		{"use_cache", "/tmp/s3fs", ""},
+		{"use_cache", "/var/cache/s3vol/a", ""},
+		{"use_cache", "/tmp/../etc", "must be in"},
+		{"use_cache", "/tmpfoo", "must be in"},
+		{"use_cache", "tmp/s3fs", "must be an absolute path"},
+	}
+	for _, test := range tests {
+		err := d.validateOption(s3fsOptions, test.key, test.value)
+		switch {
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("validateOption(%q, %q) failed: %s", test.key, test.value, err)
+		case len(test.err) > 0 && err == nil:
+			t.Errorf("validateOption(%q, %q) didn't fail, expected %q", test.key, test.value, test.err)
+		case len(test.err) > 0 && !strings.Contains(err.Error(), test.err):
+			t.Errorf("validateOption(%q, %q) = %q, expected %q", test.key, test.value, err, test.err)
+		}
+	}
+}
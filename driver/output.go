@@ -0,0 +1,91 @@
+package driver
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mountOutputLines is the number of output lines kept for a mount
+const mountOutputLines = 50
+
+// outputLevels are the log levels of the s3fs message tags
+var outputLevels = map[string]log.Level{
+	"[CRT]": log.ErrorLevel,
+	"[ERR]": log.ErrorLevel,
+	"[WAN]": log.WarnLevel,
+	"[INF]": log.InfoLevel,
+	"[DBG]": log.DebugLevel,
+}
+
+// dbgLevels are the values of the s3fs dbglevel option
+var dbgLevels = []string{"crit", "critical", "err", "error", "warn", "warning", "info", "information", "dbg", "debug"}
+
+// mountOutput streams the output of a mount process to the logs
+// and keeps its last lines in a ring
+type mountOutput struct {
+	sync.Mutex
+	entry   *log.Entry
+	partial []byte
+	lines   []string
+	next    int
+}
+
+// newMountOutput creates the output of the mount process of a volume
+func newMountOutput(volConfig *VolConfig, backend string) *mountOutput {
+	return &mountOutput{
+		entry: log.WithField("command", "driver").WithField("method", "output").WithField("volume", volConfig.Name).WithField("bucket", volConfig.Bucket).WithField("backend", backend),
+		lines: make([]string, 0, mountOutputLines),
+	}
+}
+
+// outputLevel gets the log level of an output line
+func outputLevel(line string) log.Level {
+	for tag, level := range outputLevels {
+		if strings.Contains(line, tag) {
+			return level
+		}
+	}
+	return log.InfoLevel
+}
+
+// Write logs and keeps the complete lines
+func (o *mountOutput) Write(p []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(o.partial[:i]), "\r")
+		o.partial = o.partial[i+1:]
+		if len(line) == 0 {
+			continue
+		}
+		o.entry.Log(outputLevel(line), line)
+		if len(o.lines) < mountOutputLines {
+			o.lines = append(o.lines, line)
+			continue
+		}
+		o.lines[o.next] = line
+		o.next = (o.next + 1) % mountOutputLines
+	}
+	return len(p), nil
+}
+
+// Lines gets the kept lines, oldest first
+func (o *mountOutput) Lines() []string {
+	o.Lock()
+	defer o.Unlock()
+	lines := make([]string, 0, len(o.lines)+1)
+	lines = append(lines, o.lines[o.next:]...)
+	lines = append(lines, o.lines[:o.next]...)
+	if len(o.partial) > 0 {
+		lines = append(lines, string(o.partial))
+	}
+	return lines
+}
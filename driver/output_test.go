@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestOutputLevel(t *testing.T) {
+	tests := []struct {
+		line  string
+		level log.Level
+	}{
+		{"2020-01-01T10:00:00.000Z [CRT] s3fs.cpp:main(4000): could not mount", log.ErrorLevel},
+		{"2020-01-01T10:00:00.000Z [ERR] curl.cpp:RequestPerform(2000): HTTP response code 403", log.ErrorLevel},
+		{"2020-01-01T10:00:00.000Z [WAN] s3fs.cpp:s3fs_check_service(3000): bucket region mismatch", log.WarnLevel},
+		{"2020-01-01T10:00:00.000Z [INF] s3fs.cpp:main(4000): starting", log.InfoLevel},
+		{"2020-01-01T10:00:00.000Z [DBG] curl.cpp:insertV4Headers(2500): computing signature", log.DebugLevel},
+		{"goofys: mounted", log.InfoLevel},
+		{"", log.InfoLevel},
+	}
+	for _, test := range tests {
+		level := outputLevel(test.line)
+		if level != test.level {
+			t.Errorf("outputLevel(%q) = %s, expected %s", test.line, level, test.level)
+		}
+	}
+}
+
+// newTestOutput gets a mount output logging to a test hook
+func newTestOutput() (*mountOutput, *test.Hook) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(log.DebugLevel)
+	return &mountOutput{entry: log.NewEntry(logger), lines: make([]string, 0, mountOutputLines)}, hook
+}
+
+func TestMountOutputWrite(t *testing.T) {
+	tests := []struct {
+		writes []string
+		lines  []string
+		logged []string
+	}{
+		{[]string{"one\n"}, []string{"one"}, []string{"one"}},
+		{[]string{"one\ntwo\n"}, []string{"one", "two"}, []string{"one", "two"}},
+		{[]string{"o", "ne\ntw", "o\n"}, []string{"one", "two"}, []string{"one", "two"}},
+		{[]string{"one\r\n\n\r\ntwo\n"}, []string{"one", "two"}, []string{"one", "two"}},
+		// the partial line is returned but not logged yet
+		{[]string{"one\ntw"}, []string{"one", "tw"}, []string{"one"}},
+		{[]string{"partial"}, []string{"partial"}, []string{}},
+		{[]string{}, []string{}, []string{}},
+	}
+	for _, test := range tests {
+		o, hook := newTestOutput()
+		for _, w := range test.writes {
+			n, err := o.Write([]byte(w))
+			if err != nil || n != len(w) {
+				t.Errorf("Write(%q) = %d, %v", w, n, err)
+			}
+		}
+		lines := o.Lines()
+		if !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("writes %q: lines %q, expected %q", test.writes, lines, test.lines)
+		}
+		logged := make([]string, 0)
+		for _, e := range hook.AllEntries() {
+			logged = append(logged, e.Message)
+		}
+		if !reflect.DeepEqual(logged, test.logged) {
+			t.Errorf("writes %q: logged %q, expected %q", test.writes, logged, test.logged)
+		}
+	}
+}
+
+func TestMountOutputLevels(t *testing.T) {
+	o, hook := newTestOutput()
+	o.Write([]byte("[ERR] failed\n[WAN] slow\n[DBG] detail\nplain\n"))
+	expected := []log.Level{log.ErrorLevel, log.WarnLevel, log.DebugLevel, log.InfoLevel}
+	entries := hook.AllEntries()
+	if len(entries) != len(expected) {
+		t.Fatalf("logged %d lines, expected %d", len(entries), len(expected))
+	}
+	for i, e := range entries {
+		if e.Level != expected[i] {
+			t.Errorf("line %q logged at %s, expected %s", e.Message, e.Level, expected[i])
+		}
+	}
+}
+
+func TestMountOutputRing(t *testing.T) {
+	tests := []struct {
+		written int
+		first   int
+	}{
+		{mountOutputLines - 1, 0},
+		{mountOutputLines, 0},
+		{mountOutputLines + 1, 1},
+		{2*mountOutputLines + 7, mountOutputLines + 7},
+	}
+	for _, test := range tests {
+		o, _ := newTestOutput()
+		for i := 0; i < test.written; i++ {
+			fmt.Fprintf(o, "line %d\n", i)
+		}
+		lines := o.Lines()
+		expected := make([]string, 0)
+		for i := test.first; i < test.written; i++ {
+			expected = append(expected, fmt.Sprintf("line %d", i))
+		}
+		if !reflect.DeepEqual(lines, expected) {
+			t.Errorf("%d lines written: kept %q, expected %q", test.written, lines, expected)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	externalOption = "external"
+	purgeOption    = "purge"
+)
+
+// boolOption gets a boolean volume option
+func boolOption(options map[string]string, name string) (bool, error) {
+	value, ok := options[name]
+	if !ok {
+		return false, nil
+	}
+	// docker passes "-o external" as an empty value
+	if len(value) == 0 {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value '%s' for option %s", value, name)
+	}
+	return b, nil
+}
+
+// splitOwnership separates the external and purge settings from the volume options
+func splitOwnership(options map[string]string) (bool, bool, map[string]string, error) {
+	external, err := boolOption(options, externalOption)
+	if err != nil {
+		return false, false, nil, err
+	}
+	purge, err := boolOption(options, purgeOption)
+	if err != nil {
+		return false, false, nil, err
+	}
+	opts := make(map[string]string)
+	for k, v := range options {
+		if k != externalOption && k != purgeOption {
+			opts[k] = v
+		}
+	}
+	return external, purge, opts, nil
+}
+
+// requireBucket checks that an existing bucket is reachable
+func (d *S3fsDriver) requireBucket(clt *minio.Client, bucket string) error {
+	ok, err := clt.BucketExists(bucket)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not check existance of bucket %s: %s", bucket, err)
+		return fmt.Errorf("could not check existance of bucket %s: %s", bucket, err)
+	}
+	if !ok {
+		log.WithField("command", "driver").Errorf("bucket %s doesn't exist", bucket)
+		return fmt.Errorf("bucket %s doesn't exist", bucket)
+	}
+	return nil
+}
+
+// ownsData checks if removing the volume may delete its data
+func (v *VolConfig) ownsData(purge bool) bool {
+	return v.Owned || v.Purge || v.RemovePurge || purge
+}
@@ -0,0 +1,95 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	bucketOption = "bucket"
+	prefixOption = "prefix"
+)
+
+// prefixPart is the format of the parts of a volume prefix
+var prefixPart = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// splitBucket separates the shared bucket and prefix from the volume options
+func splitBucket(options map[string]string) (string, string, map[string]string, error) {
+	bucket := options[bucketOption]
+	prefix := strings.Trim(options[prefixOption], "/")
+	if len(bucket) > 0 && len(prefix) == 0 {
+		return "", "", nil, fmt.Errorf("a volume in a shared bucket needs a prefix")
+	}
+	if len(prefix) > 0 && len(bucket) == 0 {
+		return "", "", nil, fmt.Errorf("a volume prefix needs a shared bucket")
+	}
+	for _, part := range strings.Split(prefix, "/") {
+		if len(prefix) > 0 && (!prefixPart.MatchString(part) || part == "." || part == "..") {
+			return "", "", nil, fmt.Errorf("invalid prefix '%s'", prefix)
+		}
+	}
+	opts := make(map[string]string)
+	for k, v := range options {
+		if k != bucketOption && k != prefixOption {
+			opts[k] = v
+		}
+	}
+	return bucket, prefix, opts, nil
+}
+
+//Source gets the s3fs source of a volume (bucket or bucket:/prefix)
+func (v *VolConfig) Source() string {
+	if len(v.Prefix) == 0 {
+		return v.Bucket
+	}
+	return fmt.Sprintf("%s:/%s", v.Bucket, v.Prefix)
+}
+
+// objectPrefix gets the prefix of the objects of a volume in its bucket
+func (v *VolConfig) objectPrefix() string {
+	if len(v.Prefix) == 0 {
+		return ""
+	}
+	return v.Prefix + "/"
+}
+
+// createPrefix creates the directory of a volume in an existing shared bucket
+// it tells if the prefix was empty before
+func (d *S3fsDriver) createPrefix(clt *minio.Client, volConfig *VolConfig) (bool, error) {
+	err := d.requireBucket(clt, volConfig.Bucket)
+	if err != nil {
+		return false, err
+	}
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range clt.ListObjectsV2(volConfig.Bucket, volConfig.objectPrefix(), false, doneCh) {
+		if object.Err != nil {
+			log.WithField("command", "driver").Errorf("could not list prefix %s of bucket %s: %s", volConfig.Prefix, volConfig.Bucket, object.Err)
+			return false, fmt.Errorf("could not list prefix %s of bucket %s: %s", volConfig.Prefix, volConfig.Bucket, object.Err)
+		}
+		// existing data
+		return false, nil
+	}
+	// s3fs mounts directories with a directory object
+	_, err = clt.PutObject(volConfig.Bucket, volConfig.objectPrefix(), bytes.NewReader(nil), 0, minio.PutObjectOptions{ContentType: "application/x-directory"})
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not create prefix %s in bucket %s: %s", volConfig.Prefix, volConfig.Bucket, err)
+		return false, fmt.Errorf("could not create prefix %s in bucket %s: %s", volConfig.Prefix, volConfig.Bucket, err)
+	}
+	return true, nil
+}
+
+// removePrefix removes the objects of a volume from its shared bucket
+func (d *S3fsDriver) removePrefix(clt *minio.Client, volConfig *VolConfig) error {
+	log.WithField("command", "driver").WithField("method", "remove").Infof("removing prefix %s from bucket %s", volConfig.Prefix, volConfig.Bucket)
+	err := d.purge(clt, volConfig.Bucket, volConfig.objectPrefix())
+	if err != nil {
+		return fmt.Errorf("could not remove prefix %s from bucket %s: %s", volConfig.Prefix, volConfig.Bucket, err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package driver
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ini.v1"
+)
+
+const profileOption = "profile"
+
+//Profile is a named set of s3 connection settings
+type Profile struct {
+	Name         string `json:"name"`
+	Endpoint     string `json:"endpoint,omitempty"`
+	Region       string `json:"region,omitempty"`
+	AccessKey    string `json:"accessKey"`
+	SecretKey    string `json:"-"`
+	SessionToken string `json:"-"`
+}
+
+// profileKeys are the accepted names of the profile settings
+// (aws shared credentials or s3vol toml)
+var profileKeys = map[string][]string{
+	"endpoint":  {"endpoint_url", "endpoint", "s3_endpoint"},
+	"region":    {"region", "aws_region"},
+	"accesskey": {"aws_access_key_id", "access_key", "accesskey"},
+	"secretkey": {"aws_secret_access_key", "secret_key", "secretkey"},
+	"token":     {"aws_session_token", "session_token", "sessiontoken"},
+}
+
+// profileValue gets a profile setting under any of its names
+func profileValue(section *ini.Section, setting string) string {
+	for _, key := range profileKeys[setting] {
+		if section.HasKey(key) {
+			return strings.TrimSpace(section.Key(key).String())
+		}
+	}
+	return ""
+}
+
+// parseEndpoint gets the host and ssl usage of an s3 endpoint url
+func parseEndpoint(endpoint string) (string, bool, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", false, fmt.Errorf("could not parse enpoint: %s", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", false, fmt.Errorf("s3 scheme not http(s)")
+	}
+	return u.Host, u.Scheme == "https", nil
+}
+
+// loadProfiles reads the profiles of a credentials file
+// the aws shared credentials format and simple toml tables are both ini files
+func loadProfiles(path string) (map[string]*Profile, error) {
+	profiles := make(map[string]*Profile)
+	if len(path) == 0 {
+		return profiles, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: false}, path)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range cfg.Sections() {
+		if section.Name() == ini.DEFAULT_SECTION && len(section.Keys()) == 0 {
+			continue
+		}
+		// aws config files name their sections "profile <name>"
+		name := strings.TrimSpace(strings.TrimPrefix(section.Name(), "profile "))
+		name = strings.Trim(name, `"`)
+		if name == ini.DEFAULT_SECTION {
+			name = "default"
+		}
+		profile := &Profile{
+			Name:         name,
+			Endpoint:     profileValue(section, "endpoint"),
+			Region:       profileValue(section, "region"),
+			AccessKey:    profileValue(section, "accesskey"),
+			SecretKey:    profileValue(section, "secretkey"),
+			SessionToken: profileValue(section, "token"),
+		}
+		if len(profile.AccessKey) == 0 || len(profile.SecretKey) == 0 {
+			// role, sso or process profiles of the aws files have no static keys
+			log.WithField("command", "driver").WithField("method", "profiles").Warnf("skipping profile '%s': no access key or secret key", name)
+			continue
+		}
+		if len(profile.Endpoint) > 0 {
+			if _, _, err := parseEndpoint(profile.Endpoint); err != nil {
+				return nil, fmt.Errorf("profile '%s': %s", name, err)
+			}
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// ReloadProfiles reads the credentials file again
+func (d *S3fsDriver) ReloadProfiles() error {
+	profiles, err := loadProfiles(d.CredentialsFile)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "profiles").Errorf("could not load credentials file %s: %s", d.CredentialsFile, err)
+		return fmt.Errorf("could not load credentials file %s: %s", d.CredentialsFile, err)
+	}
+	d.profilesLock.Lock()
+	d.profiles = profiles
+	d.profilesLock.Unlock()
+	// clients and password files use the new credentials on next use
+	d.clientsLock.Lock()
+	d.clients = make(map[string]*minio.Client)
+	d.clientsLock.Unlock()
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.WithField("command", "driver").WithField("method", "profiles").Infof("credential profiles: %s", strings.Join(names, ","))
+	return nil
+}
+
+// profile gets a named profile
+func (d *S3fsDriver) profile(name string) (*Profile, error) {
+	d.profilesLock.RLock()
+	defer d.profilesLock.RUnlock()
+	p, ok := d.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown credential profile '%s'", name)
+	}
+	return p, nil
+}
+
+// splitProfile separates the profile from the volume options
+func (d *S3fsDriver) splitProfile(options map[string]string) (string, map[string]string, error) {
+	name, ok := options[profileOption]
+	if !ok {
+		return "", options, nil
+	}
+	if _, err := d.profile(name); err != nil {
+		return "", nil, err
+	}
+	opts := make(map[string]string)
+	for k, v := range options {
+		if k != profileOption {
+			opts[k] = v
+		}
+	}
+	return name, opts, nil
+}
@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		expected map[string]*Profile
+		err      string
+	}{
+		{
+			name: "aws credentials",
+			file: `[default]
+aws_access_key_id = AKIADEFAULT
+aws_secret_access_key = secret
+
+[prod]
+aws_access_key_id=AKIAPROD
+aws_secret_access_key=prodsecret
+aws_session_token=token
+region = eu-west-1
+endpoint_url = https://s3.eu-west-1.amazonaws.com
+`,
+			expected: map[string]*Profile{
+				"default": {Name: "default", AccessKey: "AKIADEFAULT", SecretKey: "secret"},
+				"prod":    {Name: "prod", Endpoint: "https://s3.eu-west-1.amazonaws.com", Region: "eu-west-1", AccessKey: "AKIAPROD", SecretKey: "prodsecret", SessionToken: "token"},
+			},
+		},
+		{
+			name: "aws config with roles",
+			file: `[profile dev]
+aws_access_key_id = AKIADEV
+aws_secret_access_key = devsecret
+region = us-east-1
+
+[profile admin]
+role_arn = arn:aws:iam::123456789012:role/admin
+source_profile = dev
+
+[profile sso]
+sso_start_url = https://example.awsapps.com/start
+sso_region = us-east-1
+`,
+			expected: map[string]*Profile{
+				"dev": {Name: "dev", Region: "us-east-1", AccessKey: "AKIADEV", SecretKey: "devsecret"},
+			},
+		},
+		{
+			name: "toml",
+			file: `# local minio
+[dev]
+access_key = "minio"
+secret_key = "minio123"
+endpoint = "http://localhost:9000"
+
+["backup"]
+accesskey = "backup"
+secretkey = "backup123"
+region = "us-west-2"
+`,
+			expected: map[string]*Profile{
+				"dev":    {Name: "dev", Endpoint: "http://localhost:9000", AccessKey: "minio", SecretKey: "minio123"},
+				"backup": {Name: "backup", Region: "us-west-2", AccessKey: "backup", SecretKey: "backup123"},
+			},
+		},
+		{
+			name: "invalid endpoint",
+			file: `[dev]
+access_key = "minio"
+secret_key = "minio123"
+endpoint = "localhost:9000"
+`,
+			err: "profile 'dev'",
+		},
+	}
+	dir, err := ioutil.TempDir("", "s3vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, test := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		err := ioutil.WriteFile(path, []byte(test.file), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		profiles, err := loadProfiles(path)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(profiles, test.expected) {
+			t.Errorf("%s: got %s, expected %s", test.name, dumpProfiles(profiles), dumpProfiles(test.expected))
+		}
+	}
+}
+
+// dumpProfiles formats profiles with their secrets for the test messages
+func dumpProfiles(profiles map[string]*Profile) string {
+	dump := make([]string, 0, len(profiles))
+	for _, p := range profiles {
+		dump = append(dump, strings.Join([]string{p.Name, p.Endpoint, p.Region, p.AccessKey, p.SecretKey, p.SessionToken}, "|"))
+	}
+	return strings.Join(dump, ", ")
+}
@@ -0,0 +1,258 @@
+package driver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	purgeWorkers  = 8
+	purgeRetries  = 5
+	purgeBackoff  = 200 * time.Millisecond
+	purgeProgress = 10 * time.Second
+	// detailedErrors is the number of errors detailed in an aggregated error
+	detailedErrors = 3
+)
+
+// purgeTarget is an object version to delete (no version for unversioned buckets)
+type purgeTarget struct {
+	key       string
+	versionID string
+}
+
+// listVersionsResult is the response of a versions listing
+type listVersionsResult struct {
+	IsTruncated         bool
+	NextKeyMarker       string
+	NextVersionIdMarker string
+	Versions            []purgeVersion `xml:"Version"`
+	DeleteMarkers       []purgeVersion `xml:"DeleteMarker"`
+}
+
+// purgeVersion is an object version or a delete marker of a versions listing
+type purgeVersion struct {
+	Key       string
+	VersionID string `xml:"VersionId"`
+}
+
+// errorList aggregates the errors of a bulk operation
+type errorList struct {
+	sync.Mutex
+	count  int
+	errors []string
+}
+
+// add records an error
+func (p *errorList) add(err error) {
+	p.Lock()
+	defer p.Unlock()
+	p.count++
+	if len(p.errors) < detailedErrors {
+		p.errors = append(p.errors, err.Error())
+	}
+}
+
+// err gets the aggregated error of an operation (nil without errors)
+func (p *errorList) err(operation string) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.count == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d errors %s: %s", p.count, operation, strings.Join(p.errors, "; "))
+}
+
+// retry calls f until it succeeds, waiting longer after each failure
+func retry(f func() error) error {
+	var err error
+	wait := purgeBackoff
+	for i := 0; i < purgeRetries; i++ {
+		err = f()
+		if err == nil {
+			return nil
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+	return err
+}
+
+// isVersioned checks if versioning was ever enabled on a bucket
+func isVersioned(clt *minio.Client, bucket string) bool {
+	conf, err := clt.GetBucketVersioning(bucket)
+	if err != nil {
+		return false
+	}
+	return len(conf.Status) > 0
+}
+
+// listVersions lists the object versions and delete markers under a prefix
+// minio-go doesn't list versions: the request is presigned
+func listVersions(clt *minio.Client, bucket string, prefix string, targets chan<- purgeTarget) error {
+	httpClient := &http.Client{Timeout: time.Minute}
+	keyMarker, versionMarker := "", ""
+	for {
+		params := url.Values{}
+		params.Set("versions", "")
+		if len(prefix) > 0 {
+			params.Set("prefix", prefix)
+		}
+		if len(keyMarker) > 0 {
+			params.Set("key-marker", keyMarker)
+		}
+		if len(versionMarker) > 0 {
+			params.Set("version-id-marker", versionMarker)
+		}
+		u, err := clt.Presign(http.MethodGet, bucket, "", time.Minute, params)
+		if err != nil {
+			return fmt.Errorf("could not sign versions listing: %s", err)
+		}
+		result := listVersionsResult{}
+		err = retry(func() error {
+			resp, err := httpClient.Get(u.String())
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("versions listing: %s", resp.Status)
+			}
+			return xml.NewDecoder(resp.Body).Decode(&result)
+		})
+		if err != nil {
+			return fmt.Errorf("could not list versions of bucket %s: %s", bucket, err)
+		}
+		for _, v := range append(result.Versions, result.DeleteMarkers...) {
+			targets <- purgeTarget{key: v.Key, versionID: v.VersionID}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		keyMarker, versionMarker = result.NextKeyMarker, result.NextVersionIdMarker
+	}
+}
+
+// listObjects lists the objects under a prefix
+func listObjects(clt *minio.Client, bucket string, prefix string, targets chan<- purgeTarget) error {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range clt.ListObjectsV2(bucket, prefix, true, doneCh) {
+		if object.Err != nil {
+			return fmt.Errorf("could not list objects of bucket %s: %s", bucket, object.Err)
+		}
+		targets <- purgeTarget{key: object.Key}
+	}
+	return nil
+}
+
+// purge deletes all the objects, versions and incomplete uploads under a prefix of a bucket
+func (d *S3fsDriver) purge(clt *minio.Client, bucket string, prefix string) error {
+	source := bucket
+	if len(prefix) > 0 {
+		source = fmt.Sprintf("%s:/%s", bucket, strings.TrimSuffix(prefix, "/"))
+	}
+	errs := &errorList{}
+	// incomplete uploads are not listed with the objects
+	doneCh := make(chan struct{})
+	for upload := range clt.ListIncompleteUploads(bucket, prefix, true, doneCh) {
+		if upload.Err != nil {
+			// some servers answer NoSuchUpload to buckets without uploads
+			if minio.ToErrorResponse(upload.Err).Code != "NoSuchUpload" {
+				errs.add(fmt.Errorf("could not list incomplete uploads: %s", upload.Err))
+			}
+			break
+		}
+		key := upload.Key
+		err := retry(func() error { return clt.RemoveIncompleteUpload(bucket, key) })
+		if err != nil {
+			errs.add(fmt.Errorf("could not abort upload of %s: %s", key, err))
+		}
+	}
+	close(doneCh)
+	// delete the objects with bounded concurrency
+	versioned := isVersioned(clt, bucket)
+	targets := make(chan purgeTarget)
+	var deleted int64
+	var wg sync.WaitGroup
+	for i := 0; i < purgeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range targets {
+				t := t
+				err := retry(func() error {
+					return clt.RemoveObjectWithOptions(bucket, t.key, minio.RemoveObjectOptions{VersionID: t.versionID})
+				})
+				if err != nil {
+					errs.add(fmt.Errorf("could not remove %s: %s", t.key, err))
+					continue
+				}
+				atomic.AddInt64(&deleted, 1)
+			}
+		}()
+	}
+	// report progress while deleting
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(purgeProgress)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.WithField("command", "driver").WithField("method", "purge").Infof("purging %s: %d objects deleted", source, atomic.LoadInt64(&deleted))
+			case <-done:
+				return
+			}
+		}
+	}()
+	var err error
+	if versioned {
+		err = listVersions(clt, bucket, prefix, targets)
+	} else {
+		err = listObjects(clt, bucket, prefix, targets)
+	}
+	close(targets)
+	wg.Wait()
+	close(done)
+	if err != nil {
+		errs.add(err)
+	}
+	log.WithField("command", "driver").WithField("method", "purge").Infof("purged %s: %d objects deleted", source, deleted)
+	// check that nothing remains
+	remaining := make(chan purgeTarget)
+	count := 0
+	counted := make(chan struct{})
+	go func() {
+		defer close(counted)
+		for range remaining {
+			count++
+		}
+	}()
+	if versioned {
+		err = listVersions(clt, bucket, prefix, remaining)
+	} else {
+		err = listObjects(clt, bucket, prefix, remaining)
+	}
+	close(remaining)
+	<-counted
+	if err != nil {
+		errs.add(err)
+	}
+	if count > 0 {
+		errs.add(fmt.Errorf("%d objects remain", count))
+	}
+	err = errs.err("purging " + source)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "purge").Errorf("%s", err)
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// mountTimeout is the default time a volume has to be ready once mounted
+	mountTimeout = 30 * time.Second
+	mountPoll    = 100 * time.Millisecond
+)
+
+// checkUsable stats and lists a mountpoint within a timeout
+// a hung filesystem leaves the check blocked until it is unmounted
+func checkUsable(mountpoint string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		info, err := os.Stat(mountpoint)
+		if err != nil {
+			done <- err
+			return
+		}
+		if !info.IsDir() {
+			done <- fmt.Errorf("%s is not a directory", mountpoint)
+			return
+		}
+		f, err := os.Open(mountpoint)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer f.Close()
+		_, err = f.Readdirnames(1)
+		if err == io.EOF {
+			// empty volume
+			err = nil
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%s is not responding", mountpoint)
+	}
+}
+
+// waitReady waits for the fuse filesystem of a mountpoint to be mounted and usable
+// while its backend process runs (nil exited channel for the native backend)
+func (d *S3fsDriver) waitReady(mountpoint string, exited <-chan error) error {
+	timeout := d.MountTimeout
+	if timeout <= 0 {
+		timeout = mountTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(mountPoll)
+	defer ticker.Stop()
+	var err error
+	for {
+		if isMounted(mountpoint) {
+			err = checkUsable(mountpoint, time.Until(deadline))
+			if err == nil {
+				return nil
+			}
+			err = fmt.Errorf("%s is mounted but not usable: %s", mountpoint, err)
+		}
+		select {
+		case exitErr := <-exited:
+			if exitErr == nil {
+				return fmt.Errorf("mount process exited before %s was ready", mountpoint)
+			}
+			return fmt.Errorf("mount process exited before %s was ready: %s", mountpoint, exitErr)
+		case <-ticker.C:
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("%s after %s", err, timeout)
+			}
+			return fmt.Errorf("%s is not mounted after %s", mountpoint, timeout)
+		}
+	}
+}
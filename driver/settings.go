@@ -0,0 +1,82 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// settingsObject holds the settings shared by the plugins and the command line
+const settingsObject = "settings.json"
+
+// driverSettings are the settings kept in the config bucket
+type driverSettings struct {
+	// Retention is the number of days the removed volumes are kept in the trash
+	Retention int `json:"retention"`
+}
+
+// readSettings reads the settings of the config bucket (nil if none were saved)
+func (d *S3fsDriver) readSettings() (*driverSettings, error) {
+	obj, err := d.s3client.GetObject(d.ConfigBucketName, settingsObject, minio.GetObjectOptions{})
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not get settings '%s' from bucket '%s': %s", settingsObject, d.ConfigBucketName, err)
+		return nil, fmt.Errorf("could not get settings '%s' from bucket '%s': %s", settingsObject, d.ConfigBucketName, err)
+	}
+	defer obj.Close()
+	settings := &driverSettings{}
+	err = json.NewDecoder(obj).Decode(settings)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil
+		}
+		log.WithField("command", "driver").Errorf("could not read settings '%s' from bucket '%s': %s", settingsObject, d.ConfigBucketName, err)
+		return nil, fmt.Errorf("could not read settings '%s' from bucket '%s': %s", settingsObject, d.ConfigBucketName, err)
+	}
+	return settings, nil
+}
+
+// loadSettings uses the retention of the config bucket unless the retention flag is set
+func (d *S3fsDriver) loadSettings(c *cli.Context) error {
+	settings, err := d.readSettings()
+	if err != nil {
+		return err
+	}
+	if settings == nil {
+		return nil
+	}
+	retention := time.Duration(settings.Retention) * 24 * time.Hour
+	if !c.IsSet("retention") {
+		d.Retention = retention
+		return nil
+	}
+	if retention != d.Retention {
+		log.WithField("command", "driver").Warnf("using a retention of %d days instead of the %d days of the config bucket", c.Int("retention"), settings.Retention)
+	}
+	return nil
+}
+
+// saveSettings writes the retention to the config bucket for the other hosts and the command line
+func (d *S3fsDriver) saveSettings() error {
+	err := d.locker.Lock(settingsObject)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not lock settings '%s' from bucket '%s': %s", settingsObject, d.ConfigBucketName, err)
+		return fmt.Errorf("could not lock settings '%s' from bucket '%s': %s", settingsObject, d.ConfigBucketName, err)
+	}
+	defer d.locker.UnLock(settingsObject)
+	data, err := json.MarshalIndent(&driverSettings{Retention: int(d.Retention / (24 * time.Hour))}, "", "  ")
+	if err != nil {
+		return err
+	}
+	reader := bytes.NewReader(data)
+	_, err = d.s3client.PutObject(d.ConfigBucketName, settingsObject, reader, reader.Size(), minio.PutObjectOptions{ContentType: "application/json"})
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not write settings '%s' to bucket '%s': %s", settingsObject, d.ConfigBucketName, err)
+		return fmt.Errorf("could not write settings '%s' to bucket '%s': %s", settingsObject, d.ConfigBucketName, err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// retentionContext gets the flags with a retention, set if not negative
+func retentionContext(days int) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.Int("retention", 0, "")
+	if days >= 0 {
+		set.Set("retention", fmt.Sprint(days))
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestRetentionSettings(t *testing.T) {
+	stub := &s3Stub{objects: map[string][]byte{}, buckets: map[string]time.Time{}}
+	plugin := newConfigDriver(t, stub)
+	cmd := &S3fsDriver{ConfigBucketName: plugin.ConfigBucketName, s3client: plugin.s3client, locker: plugin.locker}
+	// nothing saved yet
+	err := cmd.loadSettings(retentionContext(-1))
+	if err != nil || cmd.Retention != 0 {
+		t.Fatalf("unexpected retention without settings: %s, %v", cmd.Retention, err)
+	}
+	plugin.Retention = 7 * 24 * time.Hour
+	err = plugin.saveSettings()
+	if err != nil {
+		t.Fatalf("could not save settings: %s", err)
+	}
+	// the command line uses the retention of the plugins
+	err = cmd.loadSettings(retentionContext(-1))
+	if err != nil || cmd.Retention != plugin.Retention {
+		t.Errorf("unexpected retention from the settings: %s, %v", cmd.Retention, err)
+	}
+	// unless told otherwise
+	cmd.Retention = 0
+	err = cmd.loadSettings(retentionContext(0))
+	if err != nil || cmd.Retention != 0 {
+		t.Errorf("unexpected retention with the retention flag: %s, %v", cmd.Retention, err)
+	}
+}
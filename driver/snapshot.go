@@ -0,0 +1,306 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	fromSnapshotOption = "from-snapshot"
+	snapshotPrefix     = "snapshots/"
+)
+
+//Snapshot is a point in time copy of the data of a volume
+type Snapshot struct {
+	ID        string    `json:"id"`
+	Volume    string    `json:"volume"`
+	Bucket    string    `json:"bucket"`
+	Prefix    string    `json:"prefix"`
+	Objects   int64     `json:"objects"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Source is the volume config at the time of the snapshot (endpoint and credentials of the copy)
+	Source VolConfig `json:"source"`
+}
+
+// snapshotObjectName gets the name of the metadata object of a snapshot
+func snapshotObjectName(id string) string {
+	return fmt.Sprintf("%s%s%s", snapshotPrefix, id, configExt)
+}
+
+// location gets a volume config pointing to the data of a snapshot
+func (s *Snapshot) location() *VolConfig {
+	loc := s.Source
+	loc.Bucket = s.Bucket
+	loc.Prefix = strings.TrimSuffix(s.Prefix, "/")
+	return &loc
+}
+
+// splitSnapshot separates the snapshot to create the volume from
+func splitSnapshot(options map[string]string) (string, map[string]string, error) {
+	id, ok := options[fromSnapshotOption]
+	if !ok {
+		return "", options, nil
+	}
+	if err := validateVolumeName(id); err != nil {
+		return "", nil, fmt.Errorf("invalid snapshot id '%s'", id)
+	}
+	opts := make(map[string]string)
+	for k, v := range options {
+		if k != fromSnapshotOption {
+			opts[k] = v
+		}
+	}
+	return id, opts, nil
+}
+
+// readSnapshot reads the metadata of a snapshot (nil if it doesn't exist)
+func (d *S3fsDriver) readSnapshot(id string) (*Snapshot, error) {
+	object := snapshotObjectName(id)
+	obj, err := d.s3client.GetObject(d.ConfigBucketName, object, minio.GetObjectOptions{})
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not get snapshot '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return nil, fmt.Errorf("could not get snapshot '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	defer obj.Close()
+	snap := &Snapshot{}
+	err = json.NewDecoder(obj).Decode(snap)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil
+		}
+		log.WithField("command", "driver").Errorf("could not read snapshot '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return nil, fmt.Errorf("could not read snapshot '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	return snap, nil
+}
+
+// snapshot gets the metadata of an existing snapshot
+func (d *S3fsDriver) snapshot(id string) (*Snapshot, error) {
+	if err := validateVolumeName(id); err != nil {
+		return nil, fmt.Errorf("invalid snapshot id '%s'", id)
+	}
+	snap, err := d.readSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	if snap == nil {
+		log.WithField("command", "driver").Errorf("unknown snapshot '%s'", id)
+		return nil, fmt.Errorf("unknown snapshot '%s'", id)
+	}
+	return snap, nil
+}
+
+// writeSnapshot writes the metadata of a snapshot
+func (d *S3fsDriver) writeSnapshot(snap *Snapshot) error {
+	object := snapshotObjectName(snap.ID)
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not encode snapshot '%s': %s", object, err)
+		return fmt.Errorf("could not encode snapshot '%s': %s", object, err)
+	}
+	reader := bytes.NewReader(data)
+	_, err = d.s3client.PutObject(d.ConfigBucketName, object, reader, reader.Size(), minio.PutObjectOptions{ContentType: "application/json"})
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not write snapshot '%s' to bucket '%s': %s", object, d.ConfigBucketName, err)
+		return fmt.Errorf("could not write snapshot '%s' to bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	return nil
+}
+
+// checkSnapshotEndpoint checks that the data of a snapshot can be copied server side to a volume
+func (d *S3fsDriver) checkSnapshotEndpoint(snap *Snapshot, volConfig *VolConfig) error {
+	if d.volumeEndpoint(&snap.Source) != d.volumeEndpoint(volConfig) {
+		return fmt.Errorf("snapshot '%s' is not on the endpoint of volume '%s'", snap.ID, volConfig.Name)
+	}
+	return nil
+}
+
+// copySnapshot replaces the data of a volume with the data of a snapshot
+func (d *S3fsDriver) copySnapshot(clt *minio.Client, snap *Snapshot, volConfig *VolConfig) error {
+	// keys of the snapshot relative to its prefix
+	keys := make(map[string]bool)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range clt.ListObjectsV2(snap.Bucket, snap.Prefix, true, doneCh) {
+		if object.Err != nil {
+			return fmt.Errorf("could not list snapshot '%s': %s", snap.ID, object.Err)
+		}
+		keys[strings.TrimPrefix(object.Key, snap.Prefix)] = true
+	}
+	_, err := d.copyObjects(clt, snap.Bucket, snap.Prefix, volConfig.Bucket, volConfig.objectPrefix())
+	if err != nil {
+		return err
+	}
+	// remove the objects created since the snapshot
+	errs := &errorList{}
+	prefix := volConfig.objectPrefix()
+	for object := range clt.ListObjectsV2(volConfig.Bucket, prefix, true, doneCh) {
+		if object.Err != nil {
+			errs.add(fmt.Errorf("could not list objects of %s: %s", volConfig.Source(), object.Err))
+			break
+		}
+		key := strings.TrimPrefix(object.Key, prefix)
+		if len(key) == 0 || keys[key] {
+			continue
+		}
+		err = retry(func() error { return clt.RemoveObject(volConfig.Bucket, object.Key) })
+		if err != nil {
+			errs.add(fmt.Errorf("could not remove %s: %s", object.Key, err))
+		}
+	}
+	return errs.err(fmt.Sprintf("restoring snapshot %s", snap.ID))
+}
+
+//CreateSnapshot copies the data of a volume to a snapshot
+func (d *S3fsDriver) CreateSnapshot(volumeName string) (*Snapshot, error) {
+	volConfig, err := d.getVolumeConfig(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	err = volConfig.populated()
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%s.%s", volConfig.Name, time.Now().UTC().Format("20060102T150405Z"))
+	existing, err := d.readSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("snapshot '%s' already exists", id)
+	}
+	snap := &Snapshot{
+		ID:        id,
+		Volume:    volConfig.Name,
+		Bucket:    d.SnapshotBucket,
+		Prefix:    id + "/",
+		CreatedAt: time.Now().UTC(),
+		Source:    *volConfig,
+	}
+	// the snapshot bucket is on the endpoint of the volume for server side copies
+	clt, err := d.volumeClient(volConfig)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "snapshot").Errorf("could not get s3 client: %s", err)
+		return nil, fmt.Errorf("could not get s3 client: %s", err)
+	}
+	_, err = d.createBucket(clt, snap.Bucket, d.volumeRegion(volConfig))
+	if err != nil {
+		return nil, err
+	}
+	stats, err := d.copyObjects(clt, volConfig.Bucket, volConfig.objectPrefix(), snap.Bucket, snap.Prefix)
+	if err != nil {
+		// don't keep a partial snapshot
+		if pErr := d.purge(clt, snap.Bucket, snap.Prefix); pErr != nil {
+			log.WithField("command", "driver").WithField("method", "snapshot").Warnf("could not remove partial snapshot '%s': %s", id, pErr)
+		}
+		return nil, fmt.Errorf("could not snapshot volume '%s': %s", volumeName, err)
+	}
+	snap.Objects, snap.Size = stats.objects, stats.size
+	err = d.writeSnapshot(snap)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("command", "driver").WithField("method", "snapshot").Infof("created snapshot %s of volume %s", id, volumeName)
+	return snap, nil
+}
+
+//Snapshots returns the snapshots of a volume (all snapshots if no volume is provided)
+func (d *S3fsDriver) Snapshots(volumeName string) ([]*Snapshot, error) {
+	snaps := make([]*Snapshot, 0)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range d.s3client.ListObjectsV2(d.ConfigBucketName, snapshotPrefix, false, doneCh) {
+		if object.Err != nil {
+			log.WithField("command", "driver").Errorf("could not list snapshots from bucket '%s': %s", d.ConfigBucketName, object.Err)
+			return nil, fmt.Errorf("could not list snapshots from bucket '%s': %s", d.ConfigBucketName, object.Err)
+		}
+		if !strings.HasSuffix(object.Key, configExt) {
+			continue
+		}
+		snap, err := d.readSnapshot(strings.TrimSuffix(strings.TrimPrefix(object.Key, snapshotPrefix), configExt))
+		if err != nil {
+			return nil, err
+		}
+		if snap == nil || (len(volumeName) > 0 && snap.Volume != volumeName) {
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+//RestoreSnapshot replaces the data of a volume with a snapshot
+func (d *S3fsDriver) RestoreSnapshot(id string) error {
+	snap, err := d.snapshot(id)
+	if err != nil {
+		return err
+	}
+	// the hosts mounting the volume hold its mount locks
+	err = d.checkUnmounted(snap.Volume)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "snapshot").Errorf("%s: unmount it before restoring a snapshot", err)
+		return fmt.Errorf("%s: unmount it before restoring a snapshot", err)
+	}
+	object := volumeObjectName(snap.Volume)
+	err = d.locker.Lock(object)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "snapshot").Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	defer d.locker.UnLock(object)
+	volConfig, err := d.getVolumeConfig(snap.Volume)
+	if err != nil {
+		return err
+	}
+	err = d.checkSnapshotEndpoint(snap, volConfig)
+	if err != nil {
+		return err
+	}
+	clt, err := d.volumeClient(volConfig)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "snapshot").Errorf("could not get s3 client: %s", err)
+		return fmt.Errorf("could not get s3 client: %s", err)
+	}
+	err = d.copySnapshot(clt, snap, volConfig)
+	if err != nil {
+		return err
+	}
+	err = d.locker.Held(object)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "snapshot").Errorf("lock of volume %s lost during the restore: %s", snap.Volume, err)
+		return fmt.Errorf("lock of volume %s lost during the restore: %s", snap.Volume, err)
+	}
+	log.WithField("command", "driver").WithField("method", "snapshot").Infof("restored snapshot %s to volume %s", id, snap.Volume)
+	return nil
+}
+
+//DeleteSnapshot deletes a snapshot and its data
+func (d *S3fsDriver) DeleteSnapshot(id string) error {
+	snap, err := d.snapshot(id)
+	if err != nil {
+		return err
+	}
+	clt, err := d.volumeClient(snap.location())
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "snapshot").Errorf("could not get s3 client: %s", err)
+		return fmt.Errorf("could not get s3 client: %s", err)
+	}
+	err = d.purge(clt, snap.Bucket, snap.Prefix)
+	if err != nil {
+		return err
+	}
+	err = d.s3client.RemoveObject(d.ConfigBucketName, snapshotObjectName(id))
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "snapshot").Errorf("could not remove snapshot '%s': %s", id, err)
+		return fmt.Errorf("could not remove snapshot '%s': %s", id, err)
+	}
+	log.WithField("command", "driver").WithField("method", "snapshot").Infof("deleted snapshot %s", id)
+	return nil
+}
@@ -0,0 +1,192 @@
+package driver
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// usageTTL is the time a bucket usage is reused before being listed again
+const usageTTL = 5 * time.Minute
+
+// secretOptions are the parts of option names holding secrets
+var secretOptions = []string{"secret", "password", "token"}
+
+// bucketUsage is the cached usage of a bucket
+type bucketUsage struct {
+	Objects   int64
+	Size      int64
+	Updated   time.Time
+	Err       error
+	computing bool
+}
+
+// usageCache keeps the bucket usages computed in background
+type usageCache struct {
+	usages map[string]*bucketUsage
+	lock   sync.Mutex
+}
+
+// mergeOptions merges the driver default options and the volume options
+// volume options have precedence, the defaults are s3fs options
+func (d *S3fsDriver) mergeOptions(volConfig *VolConfig) map[string]string {
+	options := make(map[string]string, len(d.Defaults)+len(volConfig.Options))
+	if d.volumeBackend(volConfig) == backendS3fs {
+		for k, v := range d.Defaults {
+			options[k] = v
+		}
+	}
+	for k, v := range volConfig.Options {
+		options[k] = v
+	}
+	return options
+}
+
+// redactOptions hides the values of secret options
+func redactOptions(options map[string]string) map[string]string {
+	redacted := make(map[string]string, len(options))
+	for k, v := range options {
+		redacted[k] = v
+		for _, s := range secretOptions {
+			if strings.Contains(strings.ToLower(k), s) {
+				redacted[k] = "<redacted>"
+				break
+			}
+		}
+	}
+	return redacted
+}
+
+// usageKey gets the key of the cached usage of a volume (the same bucket name may exist on several endpoints)
+func (d *S3fsDriver) usageKey(volConfig *VolConfig) string {
+	endpoint := d.volumeEndpoint(volConfig)
+	if len(endpoint) == 0 {
+		endpoint = d.endpointURL()
+	}
+	return endpoint + "/" + volConfig.Source()
+}
+
+// bucketUsage gets the cached usage of a bucket and refreshes it in background when outdated
+func (d *S3fsDriver) bucketUsage(volConfig *VolConfig) bucketUsage {
+	key := d.usageKey(volConfig)
+	d.usage.lock.Lock()
+	defer d.usage.lock.Unlock()
+	if d.usage.usages == nil {
+		d.usage.usages = make(map[string]*bucketUsage)
+	}
+	u, ok := d.usage.usages[key]
+	if !ok {
+		u = &bucketUsage{}
+		d.usage.usages[key] = u
+	}
+	if !u.computing && time.Since(u.Updated) > usageTTL {
+		u.computing = true
+		go d.computeUsage(volConfig)
+	}
+	return *u
+}
+
+// computeUsage lists the objects of a bucket to get its usage
+func (d *S3fsDriver) computeUsage(volConfig *VolConfig) {
+	key := d.usageKey(volConfig)
+	bucket := volConfig.Source()
+	log.WithField("command", "driver").WithField("method", "usage").Debugf("computing usage of bucket %s", bucket)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	result := bucketUsage{}
+	clt, err := d.volumeClient(volConfig)
+	if err != nil {
+		result.Err = err
+		result.Updated = time.Now().UTC()
+		d.usage.lock.Lock()
+		d.usage.usages[key] = &result
+		d.usage.lock.Unlock()
+		return
+	}
+	for object := range clt.ListObjectsV2(volConfig.Bucket, volConfig.objectPrefix(), true, doneCh) {
+		if object.Err != nil {
+			log.WithField("command", "driver").WithField("method", "usage").Warnf("could not list bucket %s: %s", bucket, object.Err)
+			result.Err = object.Err
+			break
+		}
+		result.Objects++
+		result.Size += object.Size
+	}
+	result.Updated = time.Now().UTC()
+	d.usage.lock.Lock()
+	d.usage.usages[key] = &result
+	d.usage.lock.Unlock()
+	log.WithField("command", "driver").WithField("method", "usage").Debugf("bucket %s has %d objects for %d bytes", bucket, result.Objects, result.Size)
+}
+
+// volumeStatus gets the status of a volume on this host
+func (d *S3fsDriver) volumeStatus(volConfig *VolConfig) map[string]interface{} {
+	// s3fs connection options of the volume
+	options := d.mergeOptions(volConfig)
+	if d.volumeBackend(volConfig) == backendS3fs {
+		if endpoint := d.volumeEndpoint(volConfig); len(endpoint) > 0 {
+			options["url"] = endpoint
+		}
+		options["endpoint"] = d.volumeRegion(volConfig)
+	}
+	status := map[string]interface{}{
+		"backend": d.volumeBackend(volConfig),
+		"bucket":  volConfig.Bucket,
+		"prefix":  volConfig.Prefix,
+		"owned":   volConfig.Owned,
+		"options": redactOptions(options),
+		"mounted": false,
+		"refs":    0,
+		"mounts":  []string{},
+	}
+	if volConfig.Populating {
+		status["populating"] = true
+		status["populateOwner"] = volConfig.PopulateOwner.String()
+		status["interrupted"] = volConfig.populateInterrupted()
+	}
+	if volConfig.Credentials != nil {
+		status["accesskey"] = volConfig.Credentials.AccessKey
+	}
+	if len(volConfig.Profile) > 0 {
+		status["profile"] = volConfig.Profile
+	}
+	if endpoint := d.volumeEndpoint(volConfig); len(endpoint) > 0 {
+		status["endpoint"] = endpoint
+	}
+	status["region"] = d.volumeRegion(volConfig)
+	// mount on this host
+	d.mountsLock.Lock()
+	if m, ok := d.mounts[volConfig.Name]; ok && m.mounting {
+		status["mounting"] = true
+	} else if ok && len(m.IDs) > 0 {
+		status["mounted"] = true
+		status["refs"] = len(m.IDs)
+		status["mounts"] = append([]string{}, m.IDs...)
+		status["pid"] = m.PID
+		status["running"] = processAlive(m.PID)
+		status["restarts"] = m.Restarts
+		if m.output != nil {
+			status["output"] = m.output.Lines()
+		}
+		if !m.Started.IsZero() {
+			status["started"] = m.Started.Format(time.RFC3339)
+			status["uptime"] = time.Since(m.Started).Truncate(time.Second).String()
+		}
+	}
+	d.mountsLock.Unlock()
+	// bucket usage
+	u := d.bucketUsage(volConfig)
+	switch {
+	case u.Updated.IsZero():
+		status["usage"] = "computing"
+	case u.Err != nil:
+		status["usage"] = u.Err.Error()
+	default:
+		status["objects"] = u.Objects
+		status["size"] = u.Size
+		status["usage"] = u.Updated.Format(time.RFC3339)
+	}
+	return status
+}
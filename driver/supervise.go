@@ -0,0 +1,185 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// superviseBackoff is the first delay before a remount, doubled up to superviseMaxBackoff
+	superviseBackoff    = time.Second
+	superviseMaxBackoff = 5 * time.Minute
+	// superviseStable is the uptime after which a backend restarts without delay again
+	superviseStable = 10 * time.Minute
+	// superviseInterval is the check interval of the processes not started by this plugin
+	superviseInterval = 5 * time.Second
+)
+
+// startMount starts the foreground process of a backend and waits for the mount to be ready
+// it returns the process id and a channel receiving the exit of the process
+func (d *S3fsDriver) startMount(spec *mountSpec, output *mountOutput) (int, <-chan error, error) {
+	cmd := mounters[spec.backend].Command(spec.binary, spec)
+	if len(cmd.Env) > 0 || len(spec.env) > 0 {
+		cmd.Env = append(append(os.Environ(), cmd.Env...), spec.env...)
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	log.WithField("command", "driver").WithField("method", "mount").Infof("cmd: %s", strings.Join(cmd.Args, " "))
+	err := cmd.Start()
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "mount").Errorf("error executing the mount command: %s", err)
+		return 0, nil, fmt.Errorf("error executing the mount command: %s", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	err = d.waitReady(spec.mountpoint, exited)
+	if err != nil {
+		// don't leave a stuck process or mount behind
+		cmd.Process.Kill()
+		if isMounted(spec.mountpoint) {
+			lazyUnmount(spec.mountpoint)
+		}
+		if lines := output.Lines(); len(lines) > 0 {
+			message := strings.Join(lines, "\\n")
+			log.WithField("command", "driver").WithField("method", "mount").Errorf("error executing the mount command: %s: '%s'", err, message)
+			return 0, nil, fmt.Errorf("error executing the mount command: %s: '%s'", err, message)
+		}
+		log.WithField("command", "driver").WithField("method", "mount").Errorf("error executing the mount command: %s", err)
+		return 0, nil, fmt.Errorf("error executing the mount command: %s", err)
+	}
+	return cmd.Process.Pid, exited, nil
+}
+
+// watchProcess gets a channel receiving the exit of a process not started by this plugin
+func watchProcess(pid int) <-chan error {
+	exited := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(superviseInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !processAlive(pid) {
+				exited <- fmt.Errorf("process %d is gone", pid)
+				return
+			}
+		}
+	}()
+	return exited
+}
+
+// supervised checks if a mount is still in use
+func (d *S3fsDriver) supervised(m *mountInfo) bool {
+	d.mountsLock.Lock()
+	defer d.mountsLock.Unlock()
+	return d.mounts[m.Volume] == m && len(m.IDs) > 0
+}
+
+// supervise remounts a volume when its backend process exits
+// the remounts are delayed more and more while the backend keeps failing
+func (d *S3fsDriver) supervise(m *mountInfo, exited <-chan error) {
+	backoff := superviseBackoff
+	started := time.Now()
+	for {
+		err := <-exited
+		if !d.supervised(m) {
+			// unmounted
+			return
+		}
+		if time.Since(started) > superviseStable {
+			backoff = superviseBackoff
+		}
+		log.WithField("command", "driver").WithField("method", "supervise").Warnf("%s of volume %s is down (%v), remounting in %s", m.Backend, m.Volume, err, backoff)
+		// the dead mountpoint fails with "transport endpoint is not connected"
+		if isMounted(m.Mountpoint) {
+			err = lazyUnmount(m.Mountpoint)
+			if err != nil {
+				log.WithField("command", "driver").WithField("method", "supervise").Warnf("could not unmount %s: %s", m.Mountpoint, err)
+			}
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > superviseMaxBackoff {
+			backoff = superviseMaxBackoff
+		}
+		started = time.Now()
+		exited, err = d.remount(m)
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "supervise").Errorf("could not remount volume %s: %s", m.Volume, err)
+			failed := make(chan error, 1)
+			failed <- err
+			exited = failed
+			continue
+		}
+		if exited == nil {
+			return
+		}
+	}
+}
+
+// remount mounts again a volume in use (nil channel if it isn't in use anymore)
+// the mount requests of the volume wait for it
+func (d *S3fsDriver) remount(m *mountInfo) (<-chan error, error) {
+	d.mountsLock.Lock()
+	if d.mounts[m.Volume] != m || len(m.IDs) == 0 {
+		d.mountsLock.Unlock()
+		return nil, nil
+	}
+	starting := make(chan struct{})
+	m.starting = starting
+	output := m.output
+	d.mountsLock.Unlock()
+	pid, exited, output, err := d.restartVolume(m, output)
+	d.mountsLock.Lock()
+	defer d.mountsLock.Unlock()
+	m.starting = nil
+	close(starting)
+	if err != nil {
+		return nil, err
+	}
+	if d.mounts[m.Volume] != m || len(m.IDs) == 0 {
+		// unmounted meanwhile
+		log.WithField("command", "driver").WithField("method", "supervise").Infof("volume %s was unmounted while remounting, stopping %s", m.Volume, m.Backend)
+		lazyUnmount(m.Mountpoint)
+		if process, err := os.FindProcess(pid); err == nil {
+			process.Kill()
+		}
+		return nil, nil
+	}
+	m.output = output
+	m.PID = pid
+	m.Started = time.Now().UTC()
+	m.Restarts++
+	d.saveMounts()
+	log.WithField("command", "driver").WithField("method", "supervise").Infof("remounted volume %s on %s (%d restarts)", m.Volume, m.Mountpoint, m.Restarts)
+	// the remount doesn't propagate in the binds of the running containers
+	log.WithField("command", "driver").WithField("method", "supervise").Warnf("the containers of mounts %s still see the dead mount of volume %s and have to be restarted", strings.Join(m.IDs, ", "), m.Volume)
+	return exited, nil
+}
+
+// restartVolume starts again the backend of a mount (without the mount lock)
+func (d *S3fsDriver) restartVolume(m *mountInfo, output *mountOutput) (int, <-chan error, *mountOutput, error) {
+	volConfig, err := d.getVolumeConfig(m.Volume)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	spec, _, err := d.prepareMount(volConfig, m.Mountpoint)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if spec.backend != m.Backend {
+		return 0, nil, nil, fmt.Errorf("backend of volume %s changed from %s to %s", m.Volume, m.Backend, spec.backend)
+	}
+	if output == nil {
+		// re-adopted mount
+		output = newMountOutput(volConfig, spec.backend)
+	}
+	pid, exited, err := d.startMount(spec, output)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return pid, exited, output, nil
+}
@@ -0,0 +1,198 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// trashMarker is the object flagging the data of a removed volume
+	trashMarker = ".s3vol-trash"
+	trashReap   = time.Hour
+)
+
+// markerObject gets the name of the trash marker in the bucket of a volume
+func (v *VolConfig) markerObject() string {
+	return v.objectPrefix() + trashMarker
+}
+
+// trashVolume moves the config of a volume to the trash and flags its data
+func (d *S3fsDriver) trashVolume(volConfig *VolConfig) error {
+	now := time.Now().UTC()
+	volConfig.RemovedAt = &now
+	// the bucket can't be renamed: flag it with a marker object
+	clt, err := d.volumeClient(volConfig)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "trash").Errorf("could not get s3 client: %s", err)
+		return fmt.Errorf("could not get s3 client: %s", err)
+	}
+	data, err := json.Marshal(map[string]interface{}{"volume": volConfig.Name, "removedAt": now, "purgeAt": now.Add(d.Retention)})
+	if err != nil {
+		return err
+	}
+	reader := bytes.NewReader(data)
+	_, err = clt.PutObject(volConfig.Bucket, volConfig.markerObject(), reader, reader.Size(), minio.PutObjectOptions{ContentType: "application/json"})
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "trash").Warnf("could not flag %s as removed: %s", volConfig.Source(), err)
+	}
+	object := trashObjectName(volConfig.Name)
+	err = d.locker.Lock(object)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "trash").Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	defer d.locker.UnLock(object)
+	// keep the config before removing the volume
+	err = d.writeConfigObject(object, volConfig)
+	if err != nil {
+		return err
+	}
+	log.WithField("command", "driver").WithField("method", "trash").Infof("moved volume %s to the trash, purge after %s", volConfig.Name, now.Add(d.Retention).Format(time.RFC3339))
+	return d.removeVolume(volConfig)
+}
+
+// trashedVolume gets the config of a removed volume (nil if not in the trash)
+func (d *S3fsDriver) trashedVolume(volumeName string) (*VolConfig, error) {
+	return d.readVolumeConfig(trashObjectName(volumeName))
+}
+
+//TrashConfigs returns the configuration of the removed volumes
+func (d *S3fsDriver) TrashConfigs() ([]*VolConfig, error) {
+	volConfigs := make([]*VolConfig, 0)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range d.s3client.ListObjectsV2(d.ConfigBucketName, trashPrefix, false, doneCh) {
+		if object.Err != nil {
+			log.WithField("command", "driver").Errorf("could not list trash from bucket '%s': %s", d.ConfigBucketName, object.Err)
+			return nil, fmt.Errorf("could not list trash from bucket '%s': %s", d.ConfigBucketName, object.Err)
+		}
+		if !strings.HasSuffix(object.Key, configExt) {
+			continue
+		}
+		volConfig, err := d.readVolumeConfig(object.Key)
+		if err != nil {
+			return nil, err
+		}
+		if volConfig == nil {
+			// purged or restored since listed
+			continue
+		}
+		volConfigs = append(volConfigs, volConfig)
+	}
+	return volConfigs, nil
+}
+
+//RestoreVolume brings back a removed volume from the trash
+func (d *S3fsDriver) RestoreVolume(volumeName string) error {
+	trash := trashObjectName(volumeName)
+	err := d.locker.Lock(trash)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "restore").Errorf("could not lock config '%s' from bucket '%s': %s", trash, d.ConfigBucketName, err)
+		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", trash, d.ConfigBucketName, err)
+	}
+	defer d.locker.UnLock(trash)
+	volConfig, err := d.readVolumeConfig(trash)
+	if err != nil {
+		return err
+	}
+	if volConfig == nil {
+		log.WithField("command", "driver").WithField("method", "restore").Errorf("no volume '%s' in the trash", volumeName)
+		return fmt.Errorf("no volume '%s' in the trash", volumeName)
+	}
+	object := volumeObjectName(volumeName)
+	err = d.locker.Lock(object)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "restore").Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+	}
+	defer d.locker.UnLock(object)
+	existing, err := d.readVolumeConfig(object)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		log.WithField("command", "driver").WithField("method", "restore").Errorf("volume '%s' already exists", volumeName)
+		return fmt.Errorf("volume '%s' already exists", volumeName)
+	}
+	// a purge requested by the removal doesn't apply to the restored volume
+	volConfig.RemovedAt = nil
+	volConfig.RemovePurge = false
+	err = d.writeVolumeConfig(volConfig)
+	if err != nil {
+		return err
+	}
+	err = d.s3client.RemoveObject(d.ConfigBucketName, trash)
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "restore").Warnf("could not remove config '%s' from bucket '%s': %s", trash, d.ConfigBucketName, err)
+	}
+	clt, err := d.volumeClient(volConfig)
+	if err == nil {
+		err = clt.RemoveObject(volConfig.Bucket, volConfig.markerObject())
+	}
+	if err != nil {
+		log.WithField("command", "driver").WithField("method", "restore").Warnf("could not remove the removal flag of %s: %s", volConfig.Source(), err)
+	}
+	log.WithField("command", "driver").WithField("method", "restore").Infof("restored volume %s", volumeName)
+	return nil
+}
+
+// purgeTrash deletes the data of a removed volume after its retention
+func (d *S3fsDriver) purgeTrash(volumeName string) error {
+	trash := trashObjectName(volumeName)
+	err := d.locker.Lock(trash)
+	if err != nil {
+		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", trash, d.ConfigBucketName, err)
+	}
+	defer d.locker.UnLock(trash)
+	// restored or purged by another host in the mean time
+	volConfig, err := d.readVolumeConfig(trash)
+	if err != nil || volConfig == nil {
+		return err
+	}
+	if volConfig.RemovedAt == nil || time.Since(*volConfig.RemovedAt) < d.Retention {
+		return nil
+	}
+	log.WithField("command", "driver").WithField("method", "trash").Infof("purging volume %s removed at %s", volumeName, volConfig.RemovedAt.Format(time.RFC3339))
+	err = d.deleteData(volConfig)
+	if err != nil {
+		return err
+	}
+	// the config may have been restored meanwhile if the lock was lost
+	err = d.locker.Held(trash)
+	if err != nil {
+		return fmt.Errorf("could not keep lock of config '%s' while purging: %s", trash, err)
+	}
+	err = d.s3client.RemoveObject(d.ConfigBucketName, trash)
+	if err != nil {
+		return fmt.Errorf("could not remove config '%s' from bucket '%s': %s", trash, d.ConfigBucketName, err)
+	}
+	return nil
+}
+
+// reapTrash purges the removed volumes at the end of their retention
+func (d *S3fsDriver) reapTrash() {
+	ticker := time.NewTicker(trashReap)
+	defer ticker.Stop()
+	for {
+		vols, err := d.TrashConfigs()
+		if err != nil {
+			log.WithField("command", "driver").WithField("method", "trash").Errorf("could not list trash: %s", err)
+		}
+		for _, v := range vols {
+			if v.RemovedAt == nil || time.Since(*v.RemovedAt) < d.Retention {
+				continue
+			}
+			err = d.purgeTrash(v.Name)
+			if err != nil {
+				log.WithField("command", "driver").WithField("method", "trash").Errorf("could not purge volume %s: %s", v.Name, err)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -1,8 +1,6 @@
 package driver
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
 	"sort"
 	"strings"
@@ -11,7 +9,8 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func parseOptions(options string) (map[string]string, error) {
+//ParseOptions parses a comma separated list of options
+func ParseOptions(options string) (map[string]string, error) {
 	defaults := make(map[string]string)
 	if len(options) == 0 {
 		return defaults, nil
@@ -35,7 +34,8 @@ func parseOptions(options string) (map[string]string, error) {
 	return defaults, nil
 }
 
-func optionsToString(options map[string]string) string {
+//OptionsToString generates a comma separated list of options
+func OptionsToString(options map[string]string) string {
 	//gather keys
 	var keys []string
 	for k := range options {
@@ -58,226 +58,171 @@ func optionsToString(options map[string]string) string {
 	return strings.Join(strOption, ",")
 }
 
-func (d *S3fsDriver) createBucket(bucket string) error {
-	ok, err := d.s3client.BucketExists(bucket)
+// createBucket creates a bucket if needed and tells if it did
+func (d *S3fsDriver) createBucket(clt *minio.Client, bucket string, region string) (bool, error) {
+	ok, err := clt.BucketExists(bucket)
 	if err != nil {
 		log.WithField("command", "driver").Errorf("could not check existance of bucket %s: %s", bucket, err)
-		return fmt.Errorf("could not check existance of bucket %s: %s", bucket, err)
+		return false, fmt.Errorf("could not check existance of bucket %s: %s", bucket, err)
 	}
-	if !ok {
-		// create bucket
-		err = d.s3client.MakeBucket(bucket, d.Region)
-		if err != nil {
-			log.WithField("command", "driver").Errorf("could not create bucket %s: %s", bucket, err)
-			return fmt.Errorf("could not create bucket %s: %s", bucket, err)
-		}
+	if ok {
+		return false, nil
 	}
-	return nil
+	// create bucket
+	err = clt.MakeBucket(bucket, region)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not create bucket %s: %s", bucket, err)
+		return false, fmt.Errorf("could not create bucket %s: %s", bucket, err)
+	}
+	return true, nil
 }
 
 func (d *S3fsDriver) getVolumesConfig() ([]*VolConfig, error) {
-	// Lock config
-	err := d.Lock(d.ConfigBucketName, configObject)
-	if err != nil {
-		log.WithField("command", "driver").Errorf("could not lock config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return nil, fmt.Errorf("could not lock config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-	}
-	defer d.UnLock(d.ConfigBucketName, configObject)
-	// get the config object
-	obj, err := d.s3client.GetObject(d.ConfigBucketName, configObject, minio.GetObjectOptions{})
-	if err != nil {
-		log.WithField("command", "driver").Errorf("could not get config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return nil, fmt.Errorf("could not get config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-	}
 	volConfigs := make([]*VolConfig, 0)
-	// read the object
-	scanner := bufio.NewScanner(obj)
-	for scanner.Scan() {
-		// skip comments
-		if strings.HasPrefix(scanner.Text(), "#") {
-			continue
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range d.s3client.ListObjectsV2(d.ConfigBucketName, configPrefix, false, doneCh) {
+		if object.Err != nil {
+			log.WithField("command", "driver").Errorf("could not list configs from bucket '%s': %s", d.ConfigBucketName, object.Err)
+			return nil, fmt.Errorf("could not list configs from bucket '%s': %s", d.ConfigBucketName, object.Err)
 		}
-		// slit ";" and 3 max (volumename;bucket;options)
-		parts := strings.SplitN(scanner.Text(), ";", 3)
-		if len(parts) != 3 {
-			log.WithField("command", "driver").Warn("wrong line in config: %s", scanner.Text())
+		// skip locks and other objects
+		if !strings.HasSuffix(object.Key, configExt) {
 			continue
 		}
-		name := parts[0]
-		bucket := parts[1]
-		options, err := parseOptions(parts[2])
+		volConfig, err := d.readVolumeConfig(object.Key)
 		if err != nil {
-			log.WithField("command", "driver").Warn("wrong options in config for %s: %s", name, err)
+			return nil, err
+		}
+		if volConfig == nil {
+			// removed since listed
 			continue
 		}
-		volConfigs = append(volConfigs, &VolConfig{Name: name, Bucket: bucket, Options: options})
-	}
-	if err := scanner.Err(); err != nil {
-		log.WithField("command", "driver").Errorf("could not read config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return nil, fmt.Errorf("could not read config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+		volConfigs = append(volConfigs, volConfig)
 	}
 	return volConfigs, nil
 }
 
 func (d *S3fsDriver) getVolumeConfig(volumeName string) (*VolConfig, error) {
-	// Lock config
-	err := d.Lock(d.ConfigBucketName, configObject)
+	volConfig, err := d.readVolumeConfig(volumeObjectName(volumeName))
 	if err != nil {
-		log.WithField("command", "driver").Errorf("could not lock config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return nil, fmt.Errorf("could not lock config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-	}
-	defer d.UnLock(d.ConfigBucketName, configObject)
-	// get the config object
-	obj, err := d.s3client.GetObject(d.ConfigBucketName, configObject, minio.GetObjectOptions{})
-	if err != nil {
-		log.WithField("command", "driver").Errorf("could not get config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return nil, fmt.Errorf("could not get config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-	}
-	var volConfig *VolConfig
-	// read the object
-	scanner := bufio.NewScanner(obj)
-	for scanner.Scan() {
-		// skip comments
-		if strings.HasPrefix(scanner.Text(), "#") {
-			continue
-		}
-		// check that ; is in line
-		if !strings.Contains(scanner.Text(), ";") {
-			log.WithField("command", "driver").Warn("wrong line in config: %s", scanner.Text())
-			continue
-		}
-		// slit ";" and 3 max (volumename;bucket;options)
-		parts := strings.SplitN(scanner.Text(), ";", 3)
-		if len(parts) != 3 {
-			log.WithField("command", "driver").Warn("wrong line in config: %s", scanner.Text())
-			continue
-		}
-		name := parts[0]
-		if name != volumeName {
-			continue
-		}
-		bucket := parts[1]
-		options, err := parseOptions(parts[2])
-		if err != nil {
-			log.WithField("command", "driver").Warn("wrong options in config for %s: %s", name, err)
-			continue
-		}
-		volConfig = &VolConfig{Name: name, Bucket: bucket, Options: options}
-		break
-	}
-	if err := scanner.Err(); err != nil {
-		log.WithField("command", "driver").Errorf("could not read config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return nil, fmt.Errorf("could not read config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+		return nil, err
 	}
 	if volConfig == nil {
-		log.WithField("command", "driver").Warnf("could not find config for '%s': %s", volumeName, err)
-		return nil, fmt.Errorf("could not find config for '%s': %s", volumeName, err)
+		log.WithField("command", "driver").Warnf("could not find config for '%s'", volumeName)
+		return nil, fmt.Errorf("could not find config for '%s'", volumeName)
 	}
 	return volConfig, nil
 }
 
-func (d *S3fsDriver) addVolumeConfig(volConfig *VolConfig) error {
-	// create config line
-	options := optionsToString(volConfig.Options)
-	config := fmt.Sprintf("%s;%s;%s\n", volConfig.Name, volConfig.Bucket, options)
-	// get volumes config
-	vols, err := d.getVolumesConfig()
+// addVolumeConfig adds the config of a volume and tells if it didn't exist
+func (d *S3fsDriver) addVolumeConfig(volConfig *VolConfig) (bool, error) {
+	object := volumeObjectName(volConfig.Name)
+	// Lock volume config
+	err := d.locker.Lock(object)
 	if err != nil {
-		log.WithField("command", "driver").Errorf("could not get volumes config: %s", err)
-		return fmt.Errorf("could not get volumes config: %s", err)
-	}
-	for _, v := range vols {
-		if v.Name != volConfig.Name {
-			continue
-		}
-		opts := optionsToString(v.Options)
-		if opts != options {
-			log.WithField("command", "driver").Errorf("the same volume already exists with different options")
-			return fmt.Errorf("the same volume already exists with different options")
-		}
-		return nil
+		log.WithField("command", "driver").Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return false, fmt.Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
 	}
-	// Lock config
-	err = d.Lock(d.ConfigBucketName, configObject)
+	defer d.locker.UnLock(object)
+	// check for an existing config
+	existing, err := d.readVolumeConfig(object)
 	if err != nil {
-		log.WithField("command", "driver").Errorf("could not lock config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+		return false, err
 	}
-	defer d.UnLock(d.ConfigBucketName, configObject)
-	// get the config object
-	obj, err := d.s3client.GetObject(d.ConfigBucketName, configObject, minio.GetObjectOptions{})
-	if err != nil {
-		log.WithField("command", "driver").Errorf("could not get config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return fmt.Errorf("could not get config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+	if existing != nil {
+		return false, d.sameVolume(existing, volConfig)
 	}
-	// read all config
-	buf := bytes.Buffer{}
-	_, err = buf.ReadFrom(obj)
-	if err != nil {
-		log.WithField("command", "driver").Errorf("could not read config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return fmt.Errorf("could not read config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+	return true, d.writeVolumeConfig(volConfig)
+}
+
+// sameVolume checks that a volume is created again with the config it exists with
+func (d *S3fsDriver) sameVolume(existing *VolConfig, volConfig *VolConfig) error {
+	differs := make([]string, 0)
+	if existing.Bucket != volConfig.Bucket {
+		differs = append(differs, "bucket")
 	}
-	_, err = buf.WriteString(config)
-	if err != nil {
-		log.WithField("command", "driver").Errorf("could not write config '%s': %s", configObject, err)
-		return fmt.Errorf("could not write config '%s': %s", configObject, err)
+	if existing.Prefix != volConfig.Prefix {
+		differs = append(differs, "prefix")
+	}
+	if OptionsToString(existing.Options) != OptionsToString(volConfig.Options) {
+		differs = append(differs, "options")
+	}
+	if existing.Endpoint != volConfig.Endpoint {
+		differs = append(differs, "endpoint")
+	}
+	if existing.Region != volConfig.Region {
+		differs = append(differs, "region")
+	}
+	if existing.Profile != volConfig.Profile {
+		differs = append(differs, "profile")
 	}
-	reader := bytes.NewReader(buf.Bytes())
-	_, err = d.s3client.PutObject(d.ConfigBucketName, configObject, reader, reader.Size(), minio.PutObjectOptions{})
+	same, err := d.sameCredentials(existing.Credentials, volConfig.Credentials)
 	if err != nil {
-		log.WithField("command", "driver").Errorf("could not write config '%s' to bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return fmt.Errorf("could not write config '%s' to bucket '%s': %s", configObject, d.ConfigBucketName, err)
+		return err
+	}
+	if !same {
+		differs = append(differs, "credentials")
+	}
+	if d.volumeBackend(existing) != d.volumeBackend(volConfig) {
+		differs = append(differs, "backend")
+	}
+	if existing.Purge != volConfig.Purge {
+		differs = append(differs, "purge")
+	}
+	if existing.Origin != volConfig.Origin {
+		differs = append(differs, "origin")
+	}
+	if len(differs) > 0 {
+		log.WithField("command", "driver").Errorf("volume '%s' already exists with a different %s", volConfig.Name, strings.Join(differs, ", "))
+		return fmt.Errorf("volume '%s' already exists with a different %s", volConfig.Name, strings.Join(differs, ", "))
 	}
 	return nil
 }
 
-func (d *S3fsDriver) removeVolumeConfig(volumeName string) error {
-	// Lock config
-	err := d.Lock(d.ConfigBucketName, configObject)
+// sameCredentials compares the credentials of volumes (secrets are encrypted with a random nonce)
+func (d *S3fsDriver) sameCredentials(a *VolCredentials, b *VolCredentials) (bool, error) {
+	if a == nil || b == nil {
+		return a == b, nil
+	}
+	if a.AccessKey != b.AccessKey {
+		return false, nil
+	}
+	secretA, _, err := d.decryptSecret(a.SecretKey)
 	if err != nil {
-		log.WithField("command", "driver").Errorf("could not lock config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+		return false, err
 	}
-	defer d.UnLock(d.ConfigBucketName, configObject)
-	// get the config object
-	obj, err := d.s3client.GetObject(d.ConfigBucketName, configObject, minio.GetObjectOptions{})
+	secretB, _, err := d.decryptSecret(b.SecretKey)
 	if err != nil {
-		log.WithField("command", "driver").Errorf("could not get config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return fmt.Errorf("could not get config '%s' from bucket '%s': %s", configObject, d.ConfigBucketName, err)
+		return false, err
 	}
-	// read the object
-	buf := bytes.Buffer{}
-	scanner := bufio.NewScanner(obj)
-	for scanner.Scan() {
-		// skip comments
-		if strings.HasPrefix(scanner.Text(), "#") {
-			_, err := buf.WriteString(fmt.Sprintf("%s\n", scanner.Text()))
-			if err != nil {
-				log.WithField("command", "driver").Warnf("wrong cannot write to buffer: %s", err)
-			}
-			continue
-		}
-		// check that ; is in line
-		if !strings.Contains(scanner.Text(), ";") {
-			log.WithField("command", "driver").Warnf("wrong line in config: %s", scanner.Text())
-			continue
-		}
-		if strings.HasPrefix(scanner.Text(), fmt.Sprintf("%s;", volumeName)) {
-			log.WithField("command", "driver").Debugf("skipping line begining with '%s': %s", volumeName, scanner.Text())
-			continue
-		}
-		_, err := buf.WriteString(fmt.Sprintf("%s\n", scanner.Text()))
-		if err != nil {
-			log.WithField("command", "driver").Warn("wrong cannot write to buffer: %s", err)
-		}
+	return secretA == secretB, nil
+}
+
+func (d *S3fsDriver) removeVolumeConfig(volumeName string) error {
+	object := volumeObjectName(volumeName)
+	// Lock volume config
+	err := d.locker.Lock(object)
+	if err != nil {
+		log.WithField("command", "driver").Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return fmt.Errorf("could not lock config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
 	}
-	// write the config to bucket
-	log.WithField("command", "driver").Debugf("writing updated config")
-	reader := bytes.NewReader(buf.Bytes())
-	_, err = d.s3client.PutObject(d.ConfigBucketName, configObject, reader, reader.Size(), minio.PutObjectOptions{})
+	defer d.locker.UnLock(object)
+	log.WithField("command", "driver").Debugf("removing config '%s'", object)
+	err = d.s3client.RemoveObject(d.ConfigBucketName, object)
 	if err != nil {
-		log.WithField("command", "driver").Errorf("could not write config '%s' to bucket '%s': %s", configObject, d.ConfigBucketName, err)
-		return fmt.Errorf("could not write config '%s' to bucket '%s': %s", configObject, d.ConfigBucketName, err)
+		log.WithField("command", "driver").Errorf("could not remove config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
+		return fmt.Errorf("could not remove config '%s' from bucket '%s': %s", object, d.ConfigBucketName, err)
 	}
 	return nil
 }
+
+//VolumeConfigs returns the configuration of all volumes
+func (d *S3fsDriver) VolumeConfigs() ([]*VolConfig, error) {
+	return d.getVolumesConfig()
+}
+
+//VolumeConfig returns the configuration of a volume
+func (d *S3fsDriver) VolumeConfig(volumeName string) (*VolConfig, error) {
+	return d.getVolumeConfig(volumeName)
+}
@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestOptionsToString(t *testing.T) {
+	tests := []struct {
+		options  map[string]string
+		expected string
+	}{
+		{nil, ""},
+		{map[string]string{}, ""},
+		{map[string]string{"allow_other": ""}, "allow_other"},
+		{map[string]string{"allow_other": "true"}, "allow_other"},
+		{map[string]string{"allow_other": "TRUE"}, "allow_other"},
+		{map[string]string{"allow_other": "false"}, ""},
+		{map[string]string{"uid": "1000", "gid": "1000", "allow_other": ""}, "allow_other,gid=1000,uid=1000"},
+		{map[string]string{"use_cache": "/tmp/s3fs", "nonempty": "False"}, "use_cache=/tmp/s3fs"},
+	}
+	for _, test := range tests {
+		s := OptionsToString(test.options)
+		if s != test.expected {
+			t.Errorf("OptionsToString(%v) = %q, expected %q", test.options, s, test.expected)
+		}
+	}
+}
+
+func TestSameVolume(t *testing.T) {
+	d := &S3fsDriver{Backend: backendS3fs, configKey: configKey("passphrase")}
+	secret, err := d.encryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.encryptSecret("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := &VolConfig{Name: "vol", Bucket: "bucket", Prefix: "data", Options: map[string]string{"uid": "1000"}, Endpoint: "http://s3", Region: "eu", Credentials: &VolCredentials{AccessKey: "key", SecretKey: secret}}
+	for _, test := range []struct {
+		change   func(v *VolConfig)
+		expected string
+	}{
+		{func(v *VolConfig) {}, ""},
+		// the secrets are encrypted again with another nonce
+		{func(v *VolConfig) { v.Credentials.SecretKey, _ = d.encryptSecret("secret") }, ""},
+		// the default backend
+		{func(v *VolConfig) { v.Backend = backendS3fs }, ""},
+		{func(v *VolConfig) { v.Bucket = "other" }, "bucket"},
+		{func(v *VolConfig) { v.Prefix = "" }, "prefix"},
+		{func(v *VolConfig) { v.Options = nil }, "options"},
+		{func(v *VolConfig) { v.Endpoint = "http://other" }, "endpoint"},
+		{func(v *VolConfig) { v.Region = "us" }, "region"},
+		{func(v *VolConfig) { v.Credentials = nil; v.Profile = "p" }, "profile, credentials"},
+		{func(v *VolConfig) { v.Credentials.SecretKey = other }, "credentials"},
+		{func(v *VolConfig) { v.Credentials.AccessKey = "other" }, "credentials"},
+		{func(v *VolConfig) { v.Backend = backendGoofys }, "backend"},
+		{func(v *VolConfig) { v.Purge = true; v.Origin = "volume:src" }, "purge, origin"},
+	} {
+		v := *existing
+		credentials := *existing.Credentials
+		v.Credentials = &credentials
+		test.change(&v)
+		err := d.sameVolume(existing, &v)
+		if len(test.expected) == 0 && err != nil {
+			t.Errorf("unexpected error for the same volume %s: %s", dumpVolConfigs([]*VolConfig{&v}), err)
+		}
+		if len(test.expected) > 0 && (err == nil || !strings.HasSuffix(err.Error(), "a different "+test.expected)) {
+			t.Errorf("unexpected error for volume %s: %v, expected a different %s", dumpVolConfigs([]*VolConfig{&v}), err, test.expected)
+		}
+	}
+}
+
+func TestCreateReservedBucket(t *testing.T) {
+	stub := &s3Stub{objects: map[string][]byte{}, buckets: map[string]time.Time{}}
+	d := newConfigDriver(t, stub)
+	d.SnapshotBucket = "s3volsnapshots"
+	d.Backend = backendS3fs
+	for _, req := range []*volume.CreateRequest{
+		{Name: "s3vol"},
+		{Name: "s3volsnapshots"},
+		{Name: "vol", Options: map[string]string{"bucket": "s3vol", "prefix": "data"}},
+		{Name: "vol", Options: map[string]string{"bucket": "s3volsnapshots", "prefix": "data"}},
+	} {
+		err := d.Create(req)
+		if err == nil || !strings.Contains(err.Error(), "is reserved for the driver") {
+			t.Errorf("unexpected error creating volume %s with options %v: %v", req.Name, req.Options, err)
+		}
+	}
+	if len(stub.objects) > 0 {
+		t.Errorf("volumes created in the driver buckets: %v", stub.objects)
+	}
+}
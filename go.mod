@@ -3,6 +3,7 @@ module github.com/cblomart/s3vol
 go 1.14
 
 require (
+	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
 	github.com/Microsoft/go-winio v0.4.14 // indirect
 	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
 	github.com/docker/go-connections v0.4.0 // indirect
@@ -11,4 +12,5 @@ require (
 	github.com/sirupsen/logrus v1.6.0
 	github.com/urfave/cli/v2 v2.2.0
 	golang.org/x/net v0.0.0-20200513185701-a91f0712d120 // indirect
+	gopkg.in/ini.v1 v1.42.0
 )
@@ -0,0 +1,68 @@
+package locks
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cblomart/s3vol/admin"
+	"github.com/cblomart/s3vol/driver"
+	"github.com/urfave/cli/v2"
+)
+
+// output writes the locks in the requested format
+func output(c *cli.Context, locks []*driver.LockInfo) error {
+	return admin.Output(c, locks, "LOCK\tHOSTNAME\tPID\tSTARTED\tEXPIRES\tSTATE", func(w io.Writer) {
+		for _, l := range locks {
+			state := "held"
+			expires := ""
+			if !l.Expires.IsZero() {
+				expires = l.Expires.UTC().Format(time.RFC3339)
+				if time.Now().After(l.Expires) {
+					state = "expired"
+				}
+			}
+			started := ""
+			if !l.Owner.Started.IsZero() {
+				started = l.Owner.Started.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", l.Object, l.Owner.Hostname, l.Owner.PID, started, expires, state)
+		}
+	})
+}
+
+// Inspect shows the locks of the config bucket (in the lock backend)
+func Inspect(c *cli.Context) error {
+	err := admin.CheckFormat(c)
+	if err != nil {
+		return err
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	locks, err := d.Locks(c.Args().Slice()...)
+	if err != nil {
+		return err
+	}
+	return output(c, locks)
+}
+
+// Break forcibly removes locks of the config bucket
+func Break(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("provide at least one locked object")
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	for _, object := range c.Args().Slice() {
+		info, err := d.BreakLock(object)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.App.Writer, info.Object)
+	}
+	return nil
+}
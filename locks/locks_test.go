@@ -0,0 +1,77 @@
+package locks
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cblomart/s3vol/driver"
+	"github.com/urfave/cli/v2"
+)
+
+// commandContext gets a lock command context with its arguments, writing to a buffer
+func commandContext(t *testing.T, args ...string) (*cli.Context, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("format", "table", "")
+	err := set.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(&cli.App{Writer: out}, set, nil), out
+}
+
+func TestOutput(t *testing.T) {
+	started := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	expires := time.Now().Add(time.Minute).UTC()
+	locks := []*driver.LockInfo{
+		{Object: "volumes/vol1.json.ext.lock", Owner: driver.LockOwner{Hostname: "host1", PID: 42, Started: started}, Expires: expires},
+		{Object: "volumes/vol2.json.ext.lock", Owner: driver.LockOwner{Hostname: "host2"}, Expires: started},
+		{Object: "config.ext.lock", Owner: driver.LockOwner{Hostname: "old"}},
+	}
+	c, out := commandContext(t)
+	err := output(c, locks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "LOCK                        HOSTNAME  PID  STARTED               EXPIRES               STATE\n" +
+		fmt.Sprintf("volumes/vol1.json.ext.lock  host1     42   2020-05-01T10:00:00Z  %s  held\n", expires.Format(time.RFC3339)) +
+		"volumes/vol2.json.ext.lock  host2     0                          2020-05-01T10:00:00Z  expired\n" +
+		"config.ext.lock             old       0                                                held\n"
+	if out.String() != expected {
+		t.Errorf("table output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+	c, out = commandContext(t, "--format", "json")
+	err = output(c, locks[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"object": "config.ext.lock"`) || !strings.Contains(out.String(), `"hostname": "old"`) {
+		t.Errorf("json output %q doesn't match the lock", out.String())
+	}
+}
+
+func TestArguments(t *testing.T) {
+	tests := []struct {
+		name   string
+		action cli.ActionFunc
+		args   []string
+		err    string
+	}{
+		{"inspect with an unknown format", Inspect, []string{"--format", "yaml"}, "unknown output format 'yaml'"},
+		{"break without object", Break, nil, "provide at least one locked object"},
+	}
+	for _, test := range tests {
+		c, out := commandContext(t, test.args...)
+		err := test.action(c)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+		if out.Len() > 0 {
+			t.Errorf("%s: unexpected output %q", test.name, out.String())
+		}
+	}
+}
@@ -2,6 +2,8 @@ package serve
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/cblomart/s3vol/driver"
 	"github.com/docker/go-plugins-helpers/volume"
@@ -21,6 +23,18 @@ func Serve(c *cli.Context) error {
 		log.WithField("command", "serve").Errorf("cannot instantiate driver: %s", err)
 		return err
 	}
+	// reload the credential profiles on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.WithField("command", "serve").Infof("reloading credential profiles")
+			err := volDriver.ReloadProfiles()
+			if err != nil {
+				log.WithField("command", "serve").Errorf("keeping previous credential profiles: %s", err)
+			}
+		}
+	}()
 	volHandler := volume.NewHandler(volDriver)
 	log.WithField("command", "serve").Infof("listening on %s", c.String("socket"))
 	defer func() {
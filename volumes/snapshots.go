@@ -0,0 +1,95 @@
+package volumes
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cblomart/s3vol/admin"
+	"github.com/cblomart/s3vol/driver"
+	"github.com/urfave/cli/v2"
+)
+
+// outputSnapshots writes the snapshots in the requested format
+func outputSnapshots(c *cli.Context, snaps []*driver.Snapshot) error {
+	return admin.Output(c, snaps, "ID\tVOLUME\tCREATED\tOBJECTS\tSIZE", func(w io.Writer) {
+		for _, s := range snaps {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", s.ID, s.Volume, s.CreatedAt.UTC().Format(time.RFC3339), s.Objects, s.Size)
+		}
+	})
+}
+
+// SnapshotCreate snapshots volumes
+func SnapshotCreate(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("provide at least one volume name")
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	for _, name := range c.Args().Slice() {
+		snap, err := d.CreateSnapshot(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.App.Writer, snap.ID)
+	}
+	return nil
+}
+
+// SnapshotList lists the snapshots of a volume or all the snapshots
+func SnapshotList(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return fmt.Errorf("provide at most one volume name")
+	}
+	err := admin.CheckFormat(c)
+	if err != nil {
+		return err
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	snaps, err := d.Snapshots(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("could not get snapshots: %s", err)
+	}
+	return outputSnapshots(c, snaps)
+}
+
+// SnapshotRestore replaces the data of a volume with a snapshot
+func SnapshotRestore(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("provide one snapshot id")
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	err = d.RestoreSnapshot(c.Args().First())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.App.Writer, c.Args().First())
+	return nil
+}
+
+// SnapshotDelete deletes snapshots
+func SnapshotDelete(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("provide at least one snapshot id")
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	for _, id := range c.Args().Slice() {
+		err = d.DeleteSnapshot(id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.App.Writer, id)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package volumes
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cblomart/s3vol/admin"
+	"github.com/cblomart/s3vol/driver"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/urfave/cli/v2"
+)
+
+// output writes the volume configurations in the requested format
+func output(c *cli.Context, vols []*driver.VolConfig) error {
+	return admin.Output(c, vols, "NAME\tBUCKET\tCREATED\tCREATED BY\tOPTIONS\tLABELS", func(w io.Writer) {
+		for _, v := range vols {
+			created := ""
+			if !v.CreatedAt.IsZero() {
+				created = v.CreatedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", v.Name, v.Source(), created, v.CreatedBy, driver.OptionsToString(v.Options), driver.OptionsToString(v.Labels))
+		}
+	})
+}
+
+// List lists the volumes in the config bucket
+func List(c *cli.Context) error {
+	if c.NArg() > 0 {
+		return fmt.Errorf("no volume name expected, use inspect to show volumes")
+	}
+	err := admin.CheckFormat(c)
+	if err != nil {
+		return err
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	var vols []*driver.VolConfig
+	if c.Bool("trash") {
+		vols, err = d.TrashConfigs()
+	} else {
+		vols, err = d.VolumeConfigs()
+	}
+	if err != nil {
+		return fmt.Errorf("could not get volumes config: %s", err)
+	}
+	return output(c, vols)
+}
+
+// Inspect shows the details of volumes
+func Inspect(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("provide at least one volume name")
+	}
+	err := admin.CheckFormat(c)
+	if err != nil {
+		return err
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	vols := make([]*driver.VolConfig, c.NArg())
+	for i, name := range c.Args().Slice() {
+		vols[i], err = d.VolumeConfig(name)
+		if err != nil {
+			return fmt.Errorf("could not get volume config for '%s': %s", name, err)
+		}
+	}
+	return output(c, vols)
+}
+
+// Create creates a volume
+func Create(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("provide one volume name")
+	}
+	options := make(map[string]string)
+	for _, o := range c.StringSlice("opt") {
+		opts, err := driver.ParseOptions(o)
+		if err != nil {
+			return fmt.Errorf("could not parse options: %s", err)
+		}
+		for k, v := range opts {
+			options[k] = v
+		}
+	}
+	for _, l := range c.StringSlice("label") {
+		infos := strings.SplitN(l, "=", 2)
+		if len(infos) != 2 {
+			return fmt.Errorf("could not parse label: %s", l)
+		}
+		options[driver.LabelPrefix+infos[0]] = infos[1]
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	err = d.Create(&volume.CreateRequest{Name: c.Args().First(), Options: options})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.App.Writer, c.Args().First())
+	return nil
+}
+
+// Remove removes volumes
+func Remove(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("provide at least one volume name")
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	for _, name := range c.Args().Slice() {
+		err = d.RemoveVolume(name, c.Bool("purge"))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.App.Writer, name)
+	}
+	return nil
+}
+
+// Restore restores removed volumes from the trash
+func Restore(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("provide at least one volume name")
+	}
+	d, err := admin.NewDriver(c)
+	if err != nil {
+		return err
+	}
+	for _, name := range c.Args().Slice() {
+		err = d.RestoreVolume(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.App.Writer, name)
+	}
+	return nil
+}
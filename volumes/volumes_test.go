@@ -0,0 +1,99 @@
+package volumes
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cblomart/s3vol/driver"
+	"github.com/urfave/cli/v2"
+)
+
+// commandContext gets a volume command context with its arguments, writing to a buffer
+func commandContext(t *testing.T, args ...string) (*cli.Context, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("format", "table", "")
+	set.Bool("trash", false, "")
+	set.Bool("purge", false, "")
+	set.Var(&cli.StringSlice{}, "opt", "")
+	set.Var(&cli.StringSlice{}, "label", "")
+	err := set.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(&cli.App{Writer: out}, set, nil), out
+}
+
+func TestOutput(t *testing.T) {
+	vols := []*driver.VolConfig{
+		{
+			Name:      "vol1",
+			Bucket:    "bucket1",
+			Options:   map[string]string{"uid": "1000"},
+			Labels:    map[string]string{"app": "web"},
+			CreatedBy: "host1",
+			CreatedAt: time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+		},
+		{Name: "vol2", Bucket: "shared", Prefix: "vol2"},
+	}
+	c, out := commandContext(t)
+	err := output(c, vols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "NAME  BUCKET        CREATED               CREATED BY  OPTIONS   LABELS\n" +
+		"vol1  bucket1       2020-05-01T10:00:00Z  host1       uid=1000  app=web\n" +
+		"vol2  shared:/vol2                                              \n"
+	if out.String() != expected {
+		t.Errorf("table output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+	c, out = commandContext(t, "--format", "json")
+	err = output(c, vols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := []*driver.VolConfig{}
+	err = json.Unmarshal(out.Bytes(), &decoded)
+	if err != nil {
+		t.Fatalf("invalid json output %q: %s", out.String(), err)
+	}
+	if !reflect.DeepEqual(decoded, vols) {
+		t.Errorf("json output %q doesn't match the volumes", out.String())
+	}
+}
+
+func TestArguments(t *testing.T) {
+	tests := []struct {
+		name   string
+		action cli.ActionFunc
+		args   []string
+		err    string
+	}{
+		{"list with a volume", List, []string{"vol1"}, "no volume name expected"},
+		{"list with an unknown format", List, []string{"--format", "yaml"}, "unknown output format 'yaml'"},
+		{"inspect without volume", Inspect, nil, "provide at least one volume name"},
+		{"inspect with an unknown format", Inspect, []string{"--format", "yaml", "vol1"}, "unknown output format 'yaml'"},
+		{"create without volume", Create, nil, "provide one volume name"},
+		{"create with two volumes", Create, []string{"vol1", "vol2"}, "provide one volume name"},
+		{"create with an invalid label", Create, []string{"--label", "app", "vol1"}, "could not parse label: app"},
+		{"rm without volume", Remove, nil, "provide at least one volume name"},
+		{"restore without volume", Restore, nil, "provide at least one volume name"},
+		{"snapshot list with two volumes", SnapshotList, []string{"vol1", "vol2"}, "provide at most one volume name"},
+		{"snapshot restore without snapshot", SnapshotRestore, nil, "provide one snapshot id"},
+	}
+	for _, test := range tests {
+		c, out := commandContext(t, test.args...)
+		err := test.action(c)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+		if out.Len() > 0 {
+			t.Errorf("%s: unexpected output %q", test.name, out.String())
+		}
+	}
+}